@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/ostafen/demo/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errAdminDisabled     = errors.New("admin operations are disabled, since no admin token or authenticator is configured")
+	errAdminUnauthorized = errors.New("admin operations require the admin token or the credentials of an admin")
+	errAdminForbidden    = errors.New("admin operations require the admin role")
+)
+
+// AdminActor is the actor of the events recorded by the bearer of the admin token.
+const AdminActor = "admin"
+
+// authorizeAdmin checks that the request has been authenticated as an admin, and aborts it otherwise.
+func (c *EventController) authorizeAdmin(ctx *gin.Context) bool {
+	p := principal(ctx)
+	switch {
+	case p == nil && c.adminToken == "" && len(c.authenticators) == 0:
+		ctx.AbortWithError(http.StatusForbidden, errAdminDisabled)
+	case p == nil:
+		ctx.Header("WWW-Authenticate", "Bearer")
+		ctx.AbortWithError(http.StatusUnauthorized, errAdminUnauthorized)
+	case !p.HasRole(AdminRole):
+		ctx.AbortWithError(http.StatusForbidden, errAdminForbidden)
+	default:
+		return true
+	}
+	return false
+}
+
+// EraseAnswer permanently removes the history of an answer, and replies with the erasure event recorded in its place.
+// It requires admin access to the answer.
+func (c *EventController) EraseAnswer(ctx *gin.Context, key string, version int64) {
+	e, err := c.storage(ctx).EraseContext(ctx.Request.Context(), key, writeOptions(ctx, store.WithExpectedVersion(version))...)
+	if err != nil {
+		if err == store.ErrAnswerNotExist {
+			ctx.AbortWithError(http.StatusNotFound, err)
+		} else if err == store.ErrVersionMismatch {
+			ctx.AbortWithError(http.StatusPreconditionFailed, err)
+		} else {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, e)
+}
+
+// Backup sends a consistent copy of the storage, which can be restored with "service restore".
+// The copy is completed to a temporary file before being sent, so that failures are reported with an error status,
+// and clients can detect a truncated response by its Content-Length.
+func (c *EventController) Backup(ctx *gin.Context) {
+	tmp, err := os.CreateTemp("", "backup-*")
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := c.store.BackupContext(ctx.Request.Context(), tmp); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx.DataFromReader(http.StatusOK, size, "application/octet-stream", tmp, map[string]string{
+		"Content-Disposition": `attachment; filename="backup"`,
+	})
+}
@@ -1,13 +1,31 @@
 package api_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,11 +34,14 @@ import (
 	"github.com/ostafen/demo/store"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 )
 
 type ClientConfig struct {
 	Host string
+	// AdminToken is sent along with admin requests.
+	AdminToken string
 }
 
 func New(conf *ClientConfig) *TestClient {
@@ -53,29 +74,49 @@ func (c *TestClient) Create(answ *model.Answer) error {
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("answer already exist")
 	}
-	return nil
+	return json.NewDecoder(resp.Body).Decode(answ)
 }
 
+var errPreconditionFailed = fmt.Errorf("answer version does not match")
+
 func (c *TestClient) Update(answ *model.Answer) error {
+	return c.UpdateIfMatch(answ, store.AnyVersion)
+}
+
+func (c *TestClient) UpdateIfMatch(answ *model.Answer, version int64) error {
 	jsonBytes, err := json.Marshal(answ)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/answers", c.conf.Host), "application/json", bytes.NewBuffer(jsonBytes))
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/answers", c.conf.Host), bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if version != store.AnyVersion {
+		req.Header.Set("If-Match", fmt.Sprintf("\"%d\"", version))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("answer does not exist")
 	}
-	return nil
+	return json.NewDecoder(resp.Body).Decode(answ)
 }
 
 func (c *TestClient) Get(key string) (*model.Answer, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/answers/%s", c.conf.Host, key))
+	resp, err := http.Get(fmt.Sprintf("%s/answers/%s", c.conf.Host, url.PathEscape(key)))
 	if err != nil {
 		return nil, err
 	}
@@ -85,13 +126,32 @@ func (c *TestClient) Get(key string) (*model.Answer, error) {
 		return nil, fmt.Errorf("no answer with key %s", key)
 	}
 
+	answ := &model.Answer{}
+	err = json.NewDecoder(resp.Body).Decode(answ)
+	if err == nil && resp.Header.Get("ETag") != fmt.Sprintf("\"%d\"", answ.Version) {
+		return nil, fmt.Errorf("unexpected ETag header %s", resp.Header.Get("ETag"))
+	}
+	return answ, err
+}
+
+func (c *TestClient) GetAt(key string, asOf string) (*model.Answer, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/answers/%s?asOf=%s", c.conf.Host, url.PathEscape(key), url.QueryEscape(asOf)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
 	answ := &model.Answer{}
 	err = json.NewDecoder(resp.Body).Decode(answ)
 	return answ, err
 }
 
 func (c *TestClient) GetHistory(key string) ([]*model.Event, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/answers/%s/events", c.conf.Host, key))
+	resp, err := http.Get(fmt.Sprintf("%s/answers/%s/events", c.conf.Host, url.PathEscape(key)))
 	if err != nil {
 		return nil, err
 	}
@@ -102,16 +162,148 @@ func (c *TestClient) GetHistory(key string) ([]*model.Event, error) {
 	return events, err
 }
 
+func (c *TestClient) GetHistoryPage(key string, query url.Values) ([]*model.Event, string, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/answers/%s/events?%s", c.conf.Host, url.PathEscape(key), query.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var events []*model.Event
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	return events, resp.Header.Get(api.NextCursorHeader), err
+}
+
+func (c *TestClient) ReadAll(query url.Values) ([]*model.Event, string, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/events?%s", c.conf.Host, query.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var events []*model.Event
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	return events, resp.Header.Get(api.NextCursorHeader), err
+}
+
+// Stream opens a Server-Sent Events stream, and sends the received events on the returned channel.
+func (c *TestClient) Stream(ctx context.Context, path string, query url.Values) (<-chan *model.Event, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s?%s", c.conf.Host, path, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	events := make(chan *model.Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			e := &model.Event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), e); err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	return events, nil
+}
+
+func (c *TestClient) List(query url.Values) ([]*model.Answer, string, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/answers?%s", c.conf.Host, query.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var answers []*model.Answer
+	err = json.NewDecoder(resp.Body).Decode(&answers)
+	return answers, resp.Header.Get(api.NextCursorHeader), err
+}
+
+func (c *TestClient) Batch(body string) (int, map[string]any, error) {
+	resp, err := http.Post(fmt.Sprintf("%s/answers:batch", c.conf.Host), "application/json", strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	var res map[string]any
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict {
+		err = json.NewDecoder(resp.Body).Decode(&res)
+	}
+	return resp.StatusCode, res, err
+}
+
+func (c *TestClient) Restore(key string, version int64) (*model.Answer, error) {
+	body := fmt.Sprintf(`{"version": %d}`, version)
+
+	resp, err := http.Post(fmt.Sprintf("%s/answers/%s/restore", c.conf.Host, url.PathEscape(key)), "application/json", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	answ := &model.Answer{}
+	err = json.NewDecoder(resp.Body).Decode(answ)
+	return answ, err
+}
+
 func (c *TestClient) Delete(key string) error {
-	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/answers/%s", c.conf.Host, key), nil)
+	return c.DeleteIfMatch(key, store.AnyVersion)
+}
+
+func (c *TestClient) DeleteIfMatch(key string, version int64) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/answers/%s", c.conf.Host, url.PathEscape(key)), nil)
 	if err != nil {
 		return err
 	}
 
+	if version != store.AnyVersion {
+		req.Header.Set("If-Match", fmt.Sprintf("\"%d\"", version))
+	}
+
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return errPreconditionFailed
+	}
 
 	if resp.StatusCode == http.StatusNoContent {
 		return fmt.Errorf("no answer with key %s", key)
@@ -119,23 +311,117 @@ func (c *TestClient) Delete(key string) error {
 	return nil
 }
 
-var clientConf = &ClientConfig{Host: "http://localhost:8080"}
+// adminRequest sends a request authorized by the admin token.
+func (c *TestClient) adminRequest(method, target string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.conf.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.conf.AdminToken)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (c *TestClient) Purge(key string) (int, *model.Event, error) {
+	resp, err := c.adminRequest(http.MethodDelete, fmt.Sprintf("%s/answers/%s?purge=true", c.conf.Host, url.PathEscape(key)), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil, nil
+	}
+
+	e := &model.Event{}
+	err = json.NewDecoder(resp.Body).Decode(e)
+	return resp.StatusCode, e, err
+}
+
+func (c *TestClient) Backup() ([]byte, error) {
+	resp, err := c.adminRequest(http.MethodPost, fmt.Sprintf("%s/admin/backup", c.conf.Host), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (c *TestClient) Export() ([]byte, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/events/export", c.conf.Host))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the trailers are only available once the body has been read
+	if msg := resp.Trailer.Get(api.ExportErrorTrailer); msg != "" {
+		return nil, fmt.Errorf("truncated export: %s", msg)
+	}
+	if count := resp.Trailer.Get(api.ExportEventsTrailer); count != strconv.Itoa(bytes.Count(data, []byte("\n"))) {
+		return nil, fmt.Errorf("truncated export: %d events, but %q reported", bytes.Count(data, []byte("\n")), count)
+	}
+	return data, nil
+}
+
+func (c *TestClient) Import(data []byte) (int, map[string]any, error) {
+	resp, err := c.adminRequest(http.MethodPost, fmt.Sprintf("%s/events/import", c.conf.Host), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	var body map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body, err
+}
+
+const adminToken = "admin-token"
+
+var clientConf = &ClientConfig{Host: "http://localhost:8080", AdminToken: adminToken}
 
-func setupServer(t *testing.T) func() {
+func setupServer(t *testing.T, opts ...api.ControllerOption) func() {
 	dir, err := os.MkdirTemp("", "test")
 	require.NoError(t, err)
 
-	s, err := store.Open(dir)
+	stop := setupServerAt(t, dir, opts...)
+	return func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// setupServerAt starts a server on top of the storage located in dir. The controller accepts the admin token,
+// and is further configured by opts.
+func setupServerAt(t *testing.T, dir string, opts ...api.ControllerOption) func() {
+	s, err := store.OpenURL(dir)
 	require.NoError(t, err)
 
-	controller := api.NewEventController(s)
+	controller := api.NewEventController(s, append([]api.ControllerOption{api.WithAdminToken(adminToken)}, opts...)...)
 
 	gin.SetMode(gin.ReleaseMode)
 	engine := gin.New()
+	engine.UseRawPath = true
 	controller.Register(engine)
 
 	hdr := engine.Handler()
 	server := http.Server{Addr: ":8080", Handler: hdr}
+	server.RegisterOnShutdown(controller.Shutdown)
 
 	done := make(chan struct{}, 1)
 	go func() {
@@ -155,7 +441,6 @@ func setupServer(t *testing.T) func() {
 		require.NoError(t, server.Shutdown(context.Background()))
 		<-done // ensure background goroutine successfully exited
 		s.Close()
-		os.RemoveAll(dir)
 	}
 }
 
@@ -243,12 +528,1200 @@ func TestGetHistory(t *testing.T) {
 
 	require.Len(t, events, 3)
 
-	require.Equal(t, &model.Event{Event: model.CreateEvent, Data: createAnsw}, events[0])
-	require.Equal(t, &model.Event{Event: model.UpdateEvent, Data: updateAnsw}, events[1])
-	require.Equal(t, &model.Event{Event: model.DeleteEvent, Data: &model.Answer{Key: "myKey"}}, events[2])
+	for _, e := range events {
+		require.False(t, e.Timestamp.IsZero())
+		e.Timestamp = time.Time{}
+
+		require.Equal(t, "127.0.0.1", e.Metadata["client_ip"])
+		e.Metadata = nil
+	}
+
+	require.Equal(t, &model.Event{ID: 1, Event: model.CreateEvent, Version: 1, Data: createAnsw}, events[0])
+	require.Equal(t, &model.Event{ID: 2, Event: model.UpdateEvent, Version: 2, Data: updateAnsw}, events[1])
+	require.Equal(t, &model.Event{ID: 3, Event: model.DeleteEvent, Version: 3, Data: &model.Answer{Key: "myKey", Version: 3}}, events[2])
 
 	events, err = c.GetHistory("myKey1")
 	require.NoError(t, err)
 
 	require.Len(t, events, 0)
 }
+
+func TestConcurrentUpdatesWithIfMatch(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	answ := &model.Answer{Key: "myKey", Value: "myValue"}
+	err := c.Create(answ)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), answ.Version)
+
+	first, err := c.Get("myKey")
+	require.NoError(t, err)
+
+	second, err := c.Get("myKey")
+	require.NoError(t, err)
+
+	first.Value = "firstValue"
+	err = c.UpdateIfMatch(first, first.Version)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), first.Version)
+
+	// the second client read the answer before the first update, so its write must be rejected
+	second.Value = "secondValue"
+	err = c.UpdateIfMatch(second, second.Version)
+	require.Equal(t, errPreconditionFailed, err)
+
+	err = c.DeleteIfMatch("myKey", 1)
+	require.Equal(t, errPreconditionFailed, err)
+
+	getAnsw, err := c.Get("myKey")
+	require.NoError(t, err)
+	require.Equal(t, first, getAnsw)
+
+	err = c.DeleteIfMatch("myKey", getAnsw.Version)
+	require.NoError(t, err)
+}
+
+func TestGetAnswerAsOf(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	createAnsw := &model.Answer{Key: "myKey", Value: "initialValue"}
+	err := c.Create(createAnsw)
+	require.NoError(t, err)
+
+	updateAnsw := &model.Answer{Key: "myKey", Value: "updatedValue"}
+	err = c.Update(updateAnsw)
+	require.NoError(t, err)
+
+	err = c.Delete("myKey")
+	require.NoError(t, err)
+
+	events, err := c.GetHistory("myKey")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	answ, err := c.GetAt("myKey", events[0].Timestamp.Format(time.RFC3339Nano))
+	require.NoError(t, err)
+	require.Equal(t, createAnsw, answ)
+
+	answ, err = c.GetAt("myKey", events[1].Timestamp.Format(time.RFC3339Nano))
+	require.NoError(t, err)
+	require.Equal(t, updateAnsw, answ)
+
+	_, err = c.GetAt("myKey", events[2].Timestamp.Format(time.RFC3339Nano))
+	require.Error(t, err)
+
+	answ, err = c.GetAt("myKey", "1")
+	require.NoError(t, err)
+	require.Equal(t, createAnsw, answ)
+
+	_, err = c.GetAt("myKey", "yesterday")
+	require.Error(t, err)
+}
+
+func TestGetHistoryPagination(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	err := c.Create(&model.Answer{Key: "myKey", Value: "initialValue"})
+	require.NoError(t, err)
+
+	for i := 0; i < 24; i++ {
+		err := c.Update(&model.Answer{Key: "myKey", Value: strconv.Itoa(i)})
+		require.NoError(t, err)
+	}
+
+	all, err := c.GetHistory("myKey")
+	require.NoError(t, err)
+	require.Len(t, all, 25)
+
+	pages := make([]*model.Event, 0)
+	query := url.Values{"limit": {"10"}, "order": {"desc"}}
+	for {
+		page, cursor, err := c.GetHistoryPage("myKey", query)
+		require.NoError(t, err)
+		pages = append(pages, page...)
+
+		if cursor == "" {
+			break
+		}
+		query.Set("after", cursor)
+	}
+
+	require.Len(t, pages, len(all))
+	for i, e := range pages {
+		require.Equal(t, all[len(all)-1-i], e)
+	}
+
+	// the cursor is not returned when the last page is exactly full
+	page, cursor, err := c.GetHistoryPage("myKey", url.Values{"limit": {"25"}})
+	require.NoError(t, err)
+	require.Len(t, page, 25)
+	require.Empty(t, cursor)
+
+	page, _, err = c.GetHistoryPage("myKey", url.Values{"type": {"create"}})
+	require.NoError(t, err)
+	require.Equal(t, all[:1], page)
+
+	page, _, err = c.GetHistoryPage("myKey", url.Values{"from": {all[20].Timestamp.Format(time.RFC3339Nano)}})
+	require.NoError(t, err)
+	require.Equal(t, all[20:], page)
+
+	_, _, err = c.GetHistoryPage("myKey", url.Values{"limit": {"0"}})
+	require.Error(t, err)
+
+	_, _, err = c.GetHistoryPage("myKey", url.Values{"type": {"unknown"}})
+	require.Error(t, err)
+}
+
+func TestReadAll(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	for i := 0; i < 10; i++ {
+		err := c.Create(&model.Answer{Key: strconv.Itoa(i), Value: strconv.Itoa(i)})
+		require.NoError(t, err)
+	}
+
+	err := c.Delete("3")
+	require.NoError(t, err)
+
+	events := make([]*model.Event, 0)
+	query := url.Values{"limit": {"4"}}
+	for {
+		page, cursor, err := c.ReadAll(query)
+		require.NoError(t, err)
+		events = append(events, page...)
+
+		if cursor == "" {
+			break
+		}
+		query.Set("from", cursor)
+	}
+
+	require.Len(t, events, 11)
+	for i, e := range events[:10] {
+		require.Equal(t, int64(i+1), e.ID)
+		require.Equal(t, model.CreateEvent, e.Event)
+		require.Equal(t, strconv.Itoa(i), e.Data.Key)
+	}
+	require.Equal(t, model.DeleteEvent, events[10].Event)
+	require.Equal(t, "3", events[10].Data.Key)
+
+	page, _, err := c.ReadAll(url.Values{"from": {"11"}})
+	require.NoError(t, err)
+	require.Equal(t, events[10:], page)
+
+	_, _, err = c.ReadAll(url.Values{"limit": {"1001"}})
+	require.Error(t, err)
+}
+
+func receiveEvents(t *testing.T, events <-chan *model.Event, n int) []*model.Event {
+	received := make([]*model.Event, 0, n)
+	for len(received) < n {
+		select {
+		case e, ok := <-events:
+			require.True(t, ok)
+			received = append(received, e)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timeout while waiting for events")
+		}
+	}
+	return received
+}
+
+func TestStreamEvents(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	for i := 0; i < 5; i++ {
+		err := c.Create(&model.Answer{Key: strconv.Itoa(i), Value: strconv.Itoa(i)})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	all, err := c.Stream(ctx, "/events/stream", url.Values{"from": {"3"}})
+	require.NoError(t, err)
+
+	single, err := c.Stream(ctx, "/answers/1/events/stream", url.Values{"from": {"1"}})
+	require.NoError(t, err)
+
+	// replayed events
+	events := receiveEvents(t, all, 3)
+	for i, e := range events {
+		require.Equal(t, int64(i+3), e.ID)
+	}
+
+	events = receiveEvents(t, single, 1)
+	require.Equal(t, int64(2), events[0].ID)
+
+	// live events
+	err = c.Update(&model.Answer{Key: "1", Value: "updated"})
+	require.NoError(t, err)
+
+	err = c.Delete("4")
+	require.NoError(t, err)
+
+	events = receiveEvents(t, all, 2)
+	require.Equal(t, int64(6), events[0].ID)
+	require.Equal(t, model.UpdateEvent, events[0].Event)
+	require.Equal(t, &model.Answer{Key: "1", Value: "updated", Version: 2}, events[0].Data)
+	require.Equal(t, int64(7), events[1].ID)
+	require.Equal(t, model.DeleteEvent, events[1].Event)
+
+	events = receiveEvents(t, single, 1)
+	require.Equal(t, int64(6), events[0].ID)
+
+	// a stream without a starting sequence number only receives new events
+	live, err := c.Stream(ctx, "/events/stream", nil)
+	require.NoError(t, err)
+
+	err = c.Create(&model.Answer{Key: "4", Value: "recreated"})
+	require.NoError(t, err)
+
+	events = receiveEvents(t, live, 1)
+	require.Equal(t, int64(8), events[0].ID)
+}
+
+func TestListAnswers(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1", "b/2"} {
+		err := c.Create(&model.Answer{Key: key, Value: "value of " + key})
+		require.NoError(t, err)
+	}
+
+	err := c.Delete("a/2")
+	require.NoError(t, err)
+
+	answers, cursor, err := c.List(url.Values{"prefix": {"a/"}, "limit": {"1"}})
+	require.NoError(t, err)
+	require.Equal(t, []*model.Answer{{Key: "a/1", Value: "value of a/1", Version: 1}}, answers)
+	require.NotEmpty(t, cursor)
+
+	answers, cursor, err = c.List(url.Values{"prefix": {"a/"}, "limit": {"1"}, "cursor": {cursor}})
+	require.NoError(t, err)
+	require.Equal(t, []*model.Answer{{Key: "a/3", Value: "value of a/3", Version: 1}}, answers)
+	require.Empty(t, cursor)
+
+	answers, _, err = c.List(url.Values{"q": {"of b"}, "order": {"desc"}})
+	require.NoError(t, err)
+	require.Len(t, answers, 2)
+	require.Equal(t, "b/2", answers[0].Key)
+	require.Equal(t, "b/1", answers[1].Key)
+
+	_, _, err = c.List(url.Values{"cursor": {"???"}})
+	require.Error(t, err)
+
+	_, _, err = c.List(url.Values{"sort": {"value"}})
+	require.Error(t, err)
+}
+
+func TestApplyBatch(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	err := c.Create(&model.Answer{Key: "existing", Value: "value"})
+	require.NoError(t, err)
+
+	status, res, err := c.Batch(`{"operations": [
+		{"op": "create", "key": "a", "value": "1"},
+		{"op": "update", "key": "a", "value": "2", "version": 1},
+		{"op": "delete", "key": "existing"}
+	]}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]any{"results": []any{
+		map[string]any{"status": float64(http.StatusCreated), "version": float64(1)},
+		map[string]any{"status": float64(http.StatusOK), "version": float64(2)},
+		map[string]any{"status": float64(http.StatusOK), "version": float64(2)},
+	}}, res)
+
+	answ, err := c.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "a", Value: "2", Version: 2}, answ)
+
+	status, res, err = c.Batch(`{"operations": [
+		{"op": "create", "key": "b", "value": "1"},
+		{"op": "create", "key": "a", "value": "1"}
+	]}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, status)
+
+	results := res["results"].([]any)
+	require.Equal(t, float64(http.StatusFailedDependency), results[0].(map[string]any)["status"])
+	require.Equal(t, float64(http.StatusConflict), results[1].(map[string]any)["status"])
+
+	_, err = c.Get("b")
+	require.Error(t, err)
+
+	// updates require a value
+	status, _, err = c.Batch(`{"operations": [{"op": "update", "key": "a"}]}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _, err = c.Batch(`{"operations": []}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRestoreAnswer(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	err := c.Create(&model.Answer{Key: "myKey", Value: "initialValue"})
+	require.NoError(t, err)
+
+	err = c.Update(&model.Answer{Key: "myKey", Value: "updatedValue"})
+	require.NoError(t, err)
+
+	err = c.Delete("myKey")
+	require.NoError(t, err)
+
+	answ, err := c.Restore("myKey", 1)
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "myKey", Value: "initialValue", Version: 4}, answ)
+
+	getAnsw, err := c.Get("myKey")
+	require.NoError(t, err)
+	require.Equal(t, answ, getAnsw)
+
+	events, _, err := c.GetHistoryPage("myKey", url.Values{"type": {"restore"}})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, int64(4), events[0].Version)
+
+	// deletes and unknown versions cannot be restored
+	_, err = c.Restore("myKey", 3)
+	require.Error(t, err)
+
+	_, err = c.Restore("myKey", 10)
+	require.Error(t, err)
+
+	_, err = c.Restore("otherKey", 1)
+	require.Error(t, err)
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	if store.DefaultScheme() != "sqlite" {
+		t.Skip("the default storage is not shared by concurrent writers")
+	}
+
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	done := setupServerAt(t, dir)
+	defer done()
+
+	// another process writing to the same database
+	other, err := store.OpenURL(dir)
+	require.NoError(t, err)
+	defer other.Close()
+
+	c := New(clientConf)
+
+	n := 8
+	writes := 25
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			for j := 0; j < writes; j++ {
+				answ := &model.Answer{Key: fmt.Sprintf("api-%d-%d", i, j), Value: "created"}
+				if err := c.Create(answ); err != nil {
+					errs <- err
+					return
+				}
+
+				answ.Value = "updated"
+				if err := c.Update(answ); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+
+		go func(i int) {
+			for j := 0; j < writes; j++ {
+				if err := other.Create(&model.Answer{Key: fmt.Sprintf("other-%d-%d", i, j), Value: "created"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+
+	for i := 0; i < 2*n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	answers, _, err := c.List(url.Values{"limit": {"1000"}})
+	require.NoError(t, err)
+	require.Len(t, answers, 2*n*writes)
+
+	for _, answ := range answers {
+		if strings.HasPrefix(answ.Key, "api-") {
+			require.Equal(t, "updated", answ.Value)
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.Create(&model.Answer{Key: strconv.Itoa(i), Value: "value"}))
+	}
+	require.NoError(t, c.Update(&model.Answer{Key: "0", Value: "updated"}))
+
+	backup, err := c.Backup()
+	require.NoError(t, err)
+
+	// backups are restricted to admins
+	require.Equal(t, http.StatusUnauthorized, request(t, http.MethodPost, "/admin/backup", nil, ""))
+	require.Equal(t, http.StatusUnauthorized, request(t, http.MethodPost, "/admin/backup", http.Header{"Authorization": {"Bearer invalid"}}, ""))
+
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	n, err := store.RestoreBackup("file://"+dir, bytes.NewReader(backup))
+	require.NoError(t, err)
+	require.Equal(t, int64(6), n)
+
+	s, err := store.OpenURL("file://" + dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	answ, err := s.GetAnswer("0")
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "0", Value: "updated", Version: 2}, answ)
+}
+
+func TestExportImport(t *testing.T) {
+	done := setupServer(t)
+
+	c := New(clientConf)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.Create(&model.Answer{Key: strconv.Itoa(i), Value: "value"}))
+	}
+	require.NoError(t, c.Delete("0"))
+
+	exported, err := c.Export()
+	require.NoError(t, err)
+	require.Equal(t, 6, bytes.Count(exported, []byte("\n")))
+	done()
+
+	// import the events into another environment
+	done = setupServer(t)
+	defer done()
+
+	status, body, err := c.Import(exported)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]any{"imported": float64(6), "skipped": float64(0)}, body)
+
+	status, body, err = c.Import(exported)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]any{"imported": float64(0), "skipped": float64(6)}, body)
+
+	reexported, err := c.Export()
+	require.NoError(t, err)
+	require.Equal(t, exported, reexported)
+
+	status, _, err = c.Import(bytes.Replace(exported, []byte(`"value":"value"`), []byte(`"value":"other"`), 1))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, status)
+
+	status, _, err = c.Import([]byte("not json\n"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestPurgeAnswer(t *testing.T) {
+	done := setupServer(t)
+	defer done()
+
+	c := New(clientConf)
+
+	require.NoError(t, c.Create(&model.Answer{Key: "key", Value: "s3cr3t-1"}))
+	require.NoError(t, c.Update(&model.Answer{Key: "key", Value: "s3cr3t-2"}))
+	require.NoError(t, c.Create(&model.Answer{Key: "other", Value: "public"}))
+
+	// erasures require the admin token
+	status, _, err := New(&ClientConfig{Host: clientConf.Host}).Purge("key")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _, err = New(&ClientConfig{Host: clientConf.Host, AdminToken: "wrong"}).Purge("key")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, _, err = c.Purge("missing")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, e, err := c.Purge("key")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, model.EraseEvent, e.Event)
+	require.Equal(t, api.AdminActor, e.Actor)
+	require.Equal(t, "2", e.Metadata[store.ErasedEventsMetadata])
+
+	_, err = c.Get("key")
+	require.Error(t, err)
+
+	_, err = c.GetAt("key", "2")
+	require.Error(t, err)
+
+	history, err := c.GetHistory("key")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, e.ID, history[0].ID)
+
+	// no previous value is recoverable from the event log, its export or a backup
+	events, _, err := c.ReadAll(nil)
+	require.NoError(t, err)
+	for _, e := range events {
+		require.NotContains(t, e.Data.Value, "s3cr3t")
+	}
+
+	exported, err := c.Export()
+	require.NoError(t, err)
+	require.NotContains(t, string(exported), "s3cr3t")
+
+	backup, err := c.Backup()
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(backup, []byte("s3cr3t")))
+
+	answ, err := c.Get("other")
+	require.NoError(t, err)
+	require.Equal(t, "public", answ.Value)
+}
+
+// request sends a request with the given headers, and returns the status code of the response.
+func request(t *testing.T, method, path string, header http.Header, body string) int {
+	req, err := http.NewRequest(method, clientConf.Host+path, strings.NewReader(body))
+	require.NoError(t, err)
+
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestAuthentication(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	digest := sha256.Sum256([]byte("bob-key"))
+	keys := fmt.Sprintf(`[
+		{"principal": "alice", "key": "alice-key"},
+		{"principal": "bob", "sha256": "%s", "roles": ["admin"]}
+	]`, hex.EncodeToString(digest[:]))
+
+	keysFile := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, []byte(keys), 0600))
+
+	apiKeys, err := api.LoadAPIKeys(keysFile)
+	require.NoError(t, err)
+
+	secret := []byte("secret")
+	tokens, err := api.NewJWTAuthenticator(api.JWTConfig{HMACSecret: secret, Issuer: "issuer"})
+	require.NoError(t, err)
+
+	done := setupServer(t, api.WithAuthenticator(apiKeys, tokens))
+	defer done()
+
+	header := func(name, value string) http.Header {
+		return http.Header{name: []string{value}, "Content-Type": []string{"application/json"}}
+	}
+	bearer := func(token string) http.Header {
+		return header("Authorization", "Bearer "+token)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	validToken := signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"sub": "carol", "iss": "issuer", "exp": expiresAt})
+
+	// unauthenticated requests are rejected
+	require.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, "/answers", nil, ""))
+	require.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, "/answers", header(api.APIKeyHeader, "wrong"), ""))
+
+	invalidTokens := []string{
+		"malformed",
+		signToken(t, jwt.SigningMethodHS256, []byte("wrong"), "", jwt.MapClaims{"sub": "carol", "iss": "issuer", "exp": expiresAt}),
+		signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"sub": "carol", "iss": "issuer", "exp": time.Now().Add(-time.Minute).Unix()}),
+		signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"sub": "carol", "iss": "issuer"}),
+		signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"sub": "carol", "iss": "other", "exp": expiresAt}),
+		signToken(t, jwt.SigningMethodHS256, secret, "", jwt.MapClaims{"iss": "issuer", "exp": expiresAt}),
+	}
+	for _, token := range invalidTokens {
+		require.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, "/answers", bearer(token), ""))
+	}
+
+	// the authenticated principal is recorded as the actor of the events
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPut, "/answers", header(api.APIKeyHeader, "alice-key"), `{"key": "key", "value": "0"}`))
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/answers", bearer(validToken), `{"key": "key", "value": "1"}`))
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/answers", bearer(adminToken), `{"key": "key", "value": "2"}`))
+
+	ops := `{"operations": [{"op": "update", "key": "key", "value": "3"}]}`
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/answers:batch", header(api.APIKeyHeader, "bob-key"), ops))
+
+	// admin operations require the admin role
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodPost, "/admin/backup", header(api.APIKeyHeader, "alice-key"), ""))
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/admin/backup", header(api.APIKeyHeader, "bob-key"), ""))
+
+	req, err := http.NewRequest(http.MethodGet, clientConf.Host+"/answers/key/events", nil)
+	require.NoError(t, err)
+	req.Header.Set(api.APIKeyHeader, "alice-key")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var history []*model.Event
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+
+	actors := make([]string, len(history))
+	for i, e := range history {
+		actors[i] = e.Actor
+	}
+	require.Equal(t, []string{"alice", "carol", api.AdminActor, "bob"}, actors)
+}
+
+func TestJWKSAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": "%s", "e": "%s"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "%s", "y": "%s"},
+		{"kty": "oct", "kid": "enc", "use": "enc", "k": "%s"}
+	]}`, encode(rsaKey.N.Bytes()), encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+		encode(ecKey.X.FillBytes(make([]byte, 32))), encode(ecKey.Y.FillBytes(make([]byte, 32))), encode([]byte("secret")))
+
+	keys, err := api.ParseJWKS([]byte(jwks))
+	require.NoError(t, err)
+
+	a, err := api.NewJWTAuthenticator(api.JWTConfig{JWKS: keys, Audience: "demo"})
+	require.NoError(t, err)
+
+	authenticate := func(token string) (*api.Principal, error) {
+		req, err := http.NewRequest(http.MethodGet, "/answers", nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(req)
+	}
+
+	claims := jwt.MapClaims{"sub": "alice", "aud": "demo", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"admin"}}
+
+	p, err := authenticate(signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims))
+	require.NoError(t, err)
+	require.Equal(t, &api.Principal{Name: "alice", Roles: []string{"admin"}}, p)
+
+	_, err = authenticate(signToken(t, jwt.SigningMethodES256, ecKey, "ec", claims))
+	require.NoError(t, err)
+
+	// the algorithm of the key must match the one of the token
+	_, err = authenticate(signToken(t, jwt.SigningMethodPS256, rsaKey, "rsa", claims))
+	require.Error(t, err)
+
+	// tokens signed with unknown keys, or keys not meant for signatures, are rejected
+	_, err = authenticate(signToken(t, jwt.SigningMethodES256, ecKey, "rsa", claims))
+	require.Error(t, err)
+
+	_, err = authenticate(signToken(t, jwt.SigningMethodHS256, []byte("secret"), "enc", claims))
+	require.Error(t, err)
+
+	_, err = authenticate(signToken(t, jwt.SigningMethodRS256, rsaKey, "", claims))
+	require.Error(t, err)
+
+	claims["aud"] = "other"
+	_, err = authenticate(signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims))
+	require.Error(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "/answers", nil)
+	require.NoError(t, err)
+
+	_, err = a.Authenticate(req)
+	require.Equal(t, api.ErrNoCredentials, err)
+}
+
+const testPolicy = `
+rules:
+  - roles: [team-a]
+    keys: ["team-a/*"]
+    access: write
+  - roles: [team-b]
+    keys: ["team-b/*"]
+    access: write
+  - principals: [carol]
+    keys: ["*"]
+    access: read
+  - principals: [dave]
+    keys: ["*"]
+    access: write
+  - roles: [admin]
+    keys: ["*"]
+    access: admin
+`
+
+func TestAuthorization(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keysFile := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(keysFile, []byte(`[
+		{"principal": "alice", "key": "alice-key", "roles": ["team-a"]},
+		{"principal": "bob", "key": "bob-key", "roles": ["team-b"]},
+		{"principal": "carol", "key": "carol-key"},
+		{"principal": "dave", "key": "dave-key"}
+	]`), 0600))
+
+	apiKeys, err := api.LoadAPIKeys(keysFile)
+	require.NoError(t, err)
+
+	policyFile := filepath.Join(dir, "policy.yaml")
+	require.NoError(t, os.WriteFile(policyFile, []byte(testPolicy), 0600))
+
+	policy, err := api.LoadPolicyFile(policyFile)
+	require.NoError(t, err)
+
+	done := setupServer(t, api.WithAuthenticator(apiKeys), api.WithAuthorizer(policy))
+	defer done()
+
+	as := func(key string) http.Header {
+		return http.Header{api.APIKeyHeader: []string{key}, "Content-Type": []string{"application/json"}}
+	}
+
+	// the reason of a denial is sent along with the 403 status
+	denial := func(header http.Header, method, path, body string) string {
+		req, err := http.NewRequest(method, clientConf.Host+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header = header
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		var res map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return res["error"]
+	}
+
+	// teams write the answers under their own prefix only
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPut, "/answers", as("alice-key"), `{"key": "team-a/x", "value": "a"}`))
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPut, "/answers", as("bob-key"), `{"key": "team-b/x", "value": "b"}`))
+	require.Equal(t, `forbidden: principal "alice" has no access to key "team-b/x"`,
+		denial(as("alice-key"), http.MethodPut, "/answers", `{"key": "team-b/x", "value": "a"}`))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodGet, "/answers/"+url.PathEscape("team-b/x"), as("alice-key"), ""))
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/answers/"+url.PathEscape("team-a/x"), as("alice-key"), ""))
+
+	// readers cannot write
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/answers/"+url.PathEscape("team-b/x"), as("carol-key"), ""))
+	require.Equal(t, `forbidden: principal "carol" has read access to key "team-b/x", but write access is required`,
+		denial(as("carol-key"), http.MethodPost, "/answers", `{"key": "team-b/x", "value": "c"}`))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodDelete, "/answers/"+url.PathEscape("team-b/x"), as("carol-key"), ""))
+
+	// listings and feeds require access to all the keys they can return
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/answers?prefix=team-a/", as("alice-key"), ""))
+	require.Equal(t, `forbidden: principal "alice" has no access to keys starting with "team-"`,
+		denial(as("alice-key"), http.MethodGet, "/answers?prefix=team-", ""))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodGet, "/events", as("alice-key"), ""))
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/answers", as("carol-key"), ""))
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/events", as("carol-key"), ""))
+
+	// a batch is denied as a whole if any of its operations is denied
+	ops := `{"operations": [{"op": "update", "key": "team-a/x", "value": "a2"}, {"op": "update", "key": "team-b/x", "value": "a2"}]}`
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodPost, "/answers:batch", as("alice-key"), ops))
+
+	// so the answer is still at its first version
+	ifMatch := as("alice-key")
+	ifMatch.Set("If-Match", `"1"`)
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/answers", ifMatch, `{"key": "team-a/x", "value": "a2"}`))
+
+	// erasures, imports and backups require admin access: imported events carry their own actor and timestamp
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodDelete, "/answers/"+url.PathEscape("team-a/x")+"?purge=true", as("alice-key"), ""))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodPost, "/events/import", as("dave-key"), ""))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodPost, "/admin/backup", as("carol-key"), ""))
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPut, "/answers", as("dave-key"), `{"key": "dave", "value": "d"}`))
+
+	status, _, err := New(clientConf).Purge("team-a/x")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	// the policy is reloaded when the file changes, while invalid changes are ignored
+	require.NoError(t, os.WriteFile(policyFile, []byte(testPolicy+`
+  - principals: [alice]
+    keys: ["team-b/*"]
+    access: write
+`), 0600))
+
+	reloaded, err := policy.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/answers", as("alice-key"), `{"key": "team-b/x", "value": "a"}`))
+
+	require.NoError(t, os.WriteFile(policyFile, []byte(`{"rules": [{"principals": ["alice"], "keys": ["*"], "access": "all"}]}`), 0600))
+
+	_, err = policy.Reload()
+	require.Error(t, err)
+	require.Equal(t, http.StatusOK, request(t, http.MethodPost, "/answers", as("alice-key"), `{"key": "team-b/x", "value": "a"}`))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodGet, "/events", as("alice-key"), ""))
+}
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := api.ParsePolicy([]byte(`{"rules": [{"roles": ["dev"], "keys": ["dev/*", "shared"], "access": "write"}]}`))
+	require.NoError(t, err)
+	require.Equal(t, &api.Policy{Rules: []api.PolicyRule{{Roles: []string{"dev"}, Keys: []string{"dev/*", "shared"}, Access: api.WriteAccess}}}, policy)
+
+	dev := &api.Principal{Name: "dan", Roles: []string{"dev"}}
+	require.NoError(t, policy.Authorize(dev, api.WriteAccess, api.KeyScope("shared")))
+	require.NoError(t, policy.Authorize(dev, api.ReadAccess, api.PrefixScope("dev/a")))
+	require.ErrorIs(t, policy.Authorize(dev, api.ReadAccess, api.PrefixScope("shared")), api.ErrForbidden)
+	require.ErrorIs(t, policy.Authorize(dev, api.AdminAccess, api.KeyScope("dev/a")), api.ErrForbidden)
+	require.ErrorIs(t, policy.Authorize(nil, api.ReadAccess, api.KeyScope("dev/a")), api.ErrForbidden)
+	require.ErrorIs(t, policy.Authorize(dev, api.ReadAccess, api.Scope{Key: "shared", Tenant: "acme"}), api.ErrForbidden)
+
+	invalid := []string{
+		`rules: [{keys: ["*"], access: read}]`,
+		`rules: [{principals: ["*"], access: read}]`,
+		`rules: [{principals: ["*"], keys: ["*"]}]`,
+		`rules: [{principals: ["*"], keys: ["*"], access: none}]`,
+		`rules: [{principals: ["*"], keys: ["*"], access: read, prefix: a}]`,
+	}
+	for _, data := range invalid {
+		_, err := api.ParsePolicy([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tenants, err := store.OpenTenants(dir)
+	require.NoError(t, err)
+	defer tenants.Close()
+
+	policy, err := api.ParsePolicy([]byte(`
+rules:
+  - roles: [admin]
+    keys: ["*"]
+    access: admin
+  - roles: [admin]
+    tenants: ["*"]
+    keys: ["*"]
+    access: admin
+  - principals: ["*"]
+    tenants: [acme]
+    keys: ["*"]
+    access: write
+`))
+	require.NoError(t, err)
+
+	done := setupServerAt(t, dir, api.WithTenants(tenants), api.WithAuthorizer(policy))
+	defer done()
+
+	admin := http.Header{"Authorization": []string{"Bearer " + adminToken}, "Content-Type": []string{"application/json"}}
+
+	// tenants are managed by admins
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodPost, "/tenants", nil, `{"name": "acme"}`))
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPost, "/tenants", admin, `{"name": "acme"}`))
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPost, "/tenants", admin, `{"name": "globex"}`))
+	require.Equal(t, http.StatusConflict, request(t, http.MethodPost, "/tenants", admin, `{"name": "acme"}`))
+	require.Equal(t, http.StatusBadRequest, request(t, http.MethodPost, "/tenants", admin, `{"name": "Initech"}`))
+
+	req, err := http.NewRequest(http.MethodGet, clientConf.Host+"/tenants", nil)
+	require.NoError(t, err)
+	req.Header = admin
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var list []map[string]string
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Equal(t, []map[string]string{{"name": "acme"}, {"name": "globex"}}, list)
+
+	acme := New(&ClientConfig{Host: clientConf.Host + "/tenants/acme", AdminToken: adminToken})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := acme.Stream(ctx, "/events/stream", url.Values{})
+	require.NoError(t, err)
+
+	// the same key is written to the default storage and to each tenant
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPut, "/answers", admin, `{"key": "key", "value": "default"}`))
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPut, "/tenants/globex/answers", admin, `{"key": "key", "value": "globex"}`))
+	require.NoError(t, acme.Create(&model.Answer{Key: "key", Value: "acme"}))
+
+	status, _, err := acme.Batch(`{"operations": [{"op": "update", "key": "key", "value": "acme-2"}, {"op": "create", "key": "other", "value": "acme"}]}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+
+	// and each tenant only sees its own answers and events
+	answ, err := acme.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "acme-2", answ.Value)
+
+	history, err := acme.GetHistory("key")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	events, _, err := acme.ReadAll(url.Values{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	answers, _, err := acme.List(url.Values{})
+	require.NoError(t, err)
+	require.Len(t, answers, 2)
+
+	for _, e := range receiveEvents(t, stream, 3) {
+		require.NotEqual(t, "globex", e.Data.Value)
+	}
+
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/answers/key", admin, ""))
+	require.Equal(t, http.StatusNotFound, request(t, http.MethodGet, "/answers/other", admin, ""))
+
+	// the policy grants access by tenant, and does not reveal which tenants exist
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodGet, "/tenants/globex/answers/key", nil, ""))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodGet, "/tenants/initech/answers/key", nil, ""))
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodGet, "/answers/key", nil, ""))
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, "/tenants/globex/answers/key", admin, ""))
+	require.Equal(t, http.StatusNotFound, request(t, http.MethodGet, "/tenants/initech/answers/key", admin, ""))
+
+	// a deleted tenant loses its answers
+	require.Equal(t, http.StatusForbidden, request(t, http.MethodDelete, "/tenants/acme", nil, ""))
+	require.Equal(t, http.StatusNoContent, request(t, http.MethodDelete, "/tenants/acme", admin, ""))
+	require.Equal(t, http.StatusNotFound, request(t, http.MethodDelete, "/tenants/acme", admin, ""))
+	require.Equal(t, http.StatusNotFound, request(t, http.MethodGet, "/tenants/acme/answers/key", admin, ""))
+
+	require.Equal(t, http.StatusCreated, request(t, http.MethodPost, "/tenants", admin, `{"name": "acme"}`))
+	require.Equal(t, http.StatusNotFound, request(t, http.MethodGet, "/tenants/acme/answers/key", nil, ""))
+}
+
+// issueCert creates a certificate from template, signed by parent, or self-signed if parent is nil,
+// and writes it with its key to PEM files named after the common name of the subject.
+func issueCert(t *testing.T, dir string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	name := filepath.Join(dir, template.Subject.CommonName)
+	require.NoError(t, os.WriteFile(name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(name+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := issueCert(t, dir, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	serverCert := func(name string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			DNSNames:    []string{"localhost"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	issueCert(t, dir, serverCert("server"), ca, caKey)
+
+	clientCert := func(name string, ou ...string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name, OrganizationalUnit: ou},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+	}
+	issueCert(t, dir, clientCert("alice"), ca, caKey)
+	issueCert(t, dir, clientCert("bob", api.AdminRole), ca, caKey)
+	issueCert(t, dir, clientCert("mallory"), nil, nil)
+
+	cert, err := api.LoadCertificate(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+
+	tlsConf, err := api.NewTLSConfig(cert, filepath.Join(dir, "ca.crt"))
+	require.NoError(t, err)
+
+	s, err := store.OpenURL(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// the organizational units of the subject grant no roles, so access is granted by principal
+	policy, err := api.ParsePolicy([]byte(`{"rules": [{"principals": ["alice"], "keys": ["*"], "access": "admin"}]}`))
+	require.NoError(t, err)
+
+	controller := api.NewEventController(s, api.WithAuthenticator(api.ClientCertAuthenticator{}), api.WithAuthorizer(policy))
+
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.UseRawPath = true
+	controller.Register(engine)
+
+	server := &http.Server{Addr: "localhost:8443", Handler: engine, TLSConfig: tlsConf}
+	server.RegisterOnShutdown(controller.Shutdown)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServeTLS("", "")
+	}()
+	time.Sleep(time.Millisecond * 10)
+
+	defer func() {
+		require.NoError(t, server.Shutdown(context.Background()))
+		require.Equal(t, http.ErrServerClosed, <-done)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// client returns an HTTP/2 client presenting the certificate of the given subject, if not empty
+	client := func(name string) *http.Client {
+		conf := &tls.Config{RootCAs: roots}
+		if name != "" {
+			clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+			require.NoError(t, err)
+			// the certificate is presented even if it is not signed by a CA accepted by the server
+			conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &clientCert, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: conf, ForceAttemptHTTP2: true}}
+	}
+
+	do := func(c *http.Client, method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, "https://localhost:8443"+path, strings.NewReader(body))
+		require.NoError(t, err)
+
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	alice := client("alice")
+
+	// the subject of the client certificate is the actor of the events
+	resp := do(alice, http.MethodPut, "/answers", `{"key": "key", "value": "value"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, 2, resp.ProtoMajor)
+
+	require.Equal(t, http.StatusOK, do(alice, http.MethodPost, "/admin/backup", "").StatusCode)
+
+	bob := client("bob")
+	require.Equal(t, http.StatusForbidden, do(bob, http.MethodPost, "/admin/backup", "").StatusCode)
+	require.Equal(t, http.StatusForbidden, do(bob, http.MethodGet, "/answers/key", "").StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, "https://localhost:8443/answers/key/events", nil)
+	require.NoError(t, err)
+
+	resp, err = alice.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var history []*model.Event
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	require.Len(t, history, 1)
+	require.Equal(t, "alice", history[0].Actor)
+
+	// clients without a certificate are not authenticated, and those with an untrusted one cannot connect
+	require.Equal(t, http.StatusUnauthorized, do(client(""), http.MethodGet, "/answers", "").StatusCode)
+
+	_, err = client("mallory").Get("https://localhost:8443/answers")
+	require.Error(t, err)
+
+	// the certificate of the server is replaced without restarting it, while invalid files are ignored
+	old := do(client("alice"), http.MethodGet, "/answers", "").TLS.PeerCertificates[0]
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "server.crt"), []byte("invalid"), 0600))
+
+	_, err = cert.Reload()
+	require.Error(t, err)
+	require.Equal(t, old.SerialNumber, do(client("alice"), http.MethodGet, "/answers", "").TLS.PeerCertificates[0].SerialNumber)
+
+	issued, _ := issueCert(t, dir, serverCert("server"), ca, caKey)
+
+	reloaded, err := cert.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+
+	current := do(client("alice"), http.MethodGet, "/answers", "").TLS.PeerCertificates[0]
+	require.NotEqual(t, old.SerialNumber, current.SerialNumber)
+	require.Equal(t, issued.SerialNumber, current.SerialNumber)
+}
@@ -0,0 +1,412 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AdminRole is the role of the principals allowed to perform admin operations.
+const AdminRole = "admin"
+
+// PrincipalKey is the key of the gin context value holding the authenticated *Principal, if any.
+const PrincipalKey = "principal"
+
+// APIKeyHeader is the header carrying the API key of a request.
+const APIKeyHeader = "X-API-Key"
+
+// ErrNoCredentials is returned by an Authenticator when the request does not carry the credentials it accepts.
+var ErrNoCredentials = errors.New("no credentials")
+
+var errUnauthenticated = errors.New("the request must be authenticated")
+
+// Principal is the identity on behalf of which a request is performed. Its name is recorded as the actor
+// of the events written by the request.
+type Principal struct {
+	Name  string
+	Roles []string
+}
+
+// HasRole reports whether p has been granted the given role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the principal performing a request.
+type Authenticator interface {
+	// Authenticate returns the principal identified by the credentials of r. It returns ErrNoCredentials
+	// if r does not carry the kind of credentials handled by the authenticator, so that others can be tried.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// WithAuthenticator requires requests to be authenticated by one of the given authenticators, tried in order.
+// It can be passed several times.
+func WithAuthenticator(authenticators ...Authenticator) ControllerOption {
+	return func(c *EventController) {
+		c.authenticators = append(c.authenticators, authenticators...)
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return header[len("Bearer "):], true
+}
+
+// adminTokenAuthenticator authenticates the bearer of the admin token as an admin.
+type adminTokenAuthenticator string
+
+func (token adminTokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	bearer, ok := bearerToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		return nil, ErrNoCredentials
+	}
+	return &Principal{Name: AdminActor, Roles: []string{AdminRole}}, nil
+}
+
+// authenticate is the middleware identifying the principal of each request. Requests are anonymous
+// if no authenticator is configured; otherwise, unauthenticated requests are rejected.
+func (c *EventController) authenticate(ctx *gin.Context) {
+	authenticators := c.authenticators
+	if c.adminToken != "" {
+		authenticators = append([]Authenticator{adminTokenAuthenticator(c.adminToken)}, authenticators...)
+	}
+
+	for _, a := range authenticators {
+		principal, err := a.Authenticate(ctx.Request)
+		if err == ErrNoCredentials {
+			continue
+		}
+
+		if err != nil {
+			ctx.Header("WWW-Authenticate", "Bearer")
+			ctx.AbortWithError(http.StatusUnauthorized, err)
+			return
+		}
+
+		ctx.Set(PrincipalKey, principal)
+		ctx.Set(ActorKey, principal.Name)
+		ctx.Next()
+		return
+	}
+
+	if len(c.authenticators) > 0 {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		ctx.AbortWithError(http.StatusUnauthorized, errUnauthenticated)
+		return
+	}
+	ctx.Next()
+}
+
+// principal returns the authenticated principal of the request, or nil if it is anonymous.
+func principal(ctx *gin.Context) *Principal {
+	if p, ok := ctx.Get(PrincipalKey); ok {
+		return p.(*Principal)
+	}
+	return nil
+}
+
+// APIKeyEntry is an entry of an API keys file. The key is given either in clear or as the hex encoded SHA-256 digest of the key.
+type APIKeyEntry struct {
+	Principal string   `json:"principal"`
+	Key       string   `json:"key,omitempty"`
+	SHA256    string   `json:"sha256,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// APIKeyAuthenticator authenticates requests by the static API key of their X-API-Key header.
+type APIKeyAuthenticator struct {
+	// principals maps the SHA-256 digest of each key to its principal
+	principals map[[sha256.Size]byte]*Principal
+}
+
+// NewAPIKeyAuthenticator returns an authenticator accepting the given keys.
+func NewAPIKeyAuthenticator(entries []APIKeyEntry) (*APIKeyAuthenticator, error) {
+	a := &APIKeyAuthenticator{principals: make(map[[sha256.Size]byte]*Principal, len(entries))}
+
+	for i, entry := range entries {
+		if entry.Principal == "" {
+			return nil, fmt.Errorf("API key %d: the principal is required", i+1)
+		}
+
+		var digest [sha256.Size]byte
+		switch {
+		case entry.Key != "" && entry.SHA256 == "":
+			digest = sha256.Sum256([]byte(entry.Key))
+		case entry.Key == "" && entry.SHA256 != "":
+			if n, err := hex.Decode(digest[:], []byte(entry.SHA256)); err != nil || n != sha256.Size {
+				return nil, fmt.Errorf("API key %d: invalid SHA-256 digest", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("API key %d: exactly one of key and sha256 is required", i+1)
+		}
+
+		if _, ok := a.principals[digest]; ok {
+			return nil, fmt.Errorf("API key %d: duplicate key", i+1)
+		}
+		a.principals[digest] = &Principal{Name: entry.Principal, Roles: entry.Roles}
+	}
+	return a, nil
+}
+
+// LoadAPIKeys reads the JSON array of APIKeyEntry held by the file with the given name.
+func LoadAPIKeys(name string) (*APIKeyAuthenticator, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []APIKeyEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid API keys file: %w", err)
+	}
+	return NewAPIKeyAuthenticator(entries)
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+
+	principal, ok := a.principals[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	return principal, nil
+}
+
+// JWTConfig configures a JWTAuthenticator. Exactly one of HMACSecret and JWKS must be set.
+type JWTConfig struct {
+	// HMACSecret verifies tokens signed with HS256, HS384 or HS512.
+	HMACSecret []byte
+	// JWKS verifies tokens signed with one of its keys, selected by the "kid" header of the token.
+	JWKS *JWKS
+	// Issuer and Audience, if not empty, must match the "iss" and "aud" claims of the tokens.
+	Issuer   string
+	Audience string
+}
+
+// JWTAuthenticator authenticates requests by the JWT of their "Authorization: Bearer" header.
+// The principal is the subject of the token, and its roles are given by the "roles" claim.
+// Tokens must have an expiration time.
+type JWTAuthenticator struct {
+	keyFunc jwt.Keyfunc
+	parser  *jwt.Parser
+}
+
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// NewJWTAuthenticator returns an authenticator verifying tokens according to conf.
+func NewJWTAuthenticator(conf JWTConfig) (*JWTAuthenticator, error) {
+	var methods []string
+	var keyFunc jwt.Keyfunc
+
+	switch {
+	case len(conf.HMACSecret) > 0 && conf.JWKS == nil:
+		methods = []string{"HS256", "HS384", "HS512"}
+		keyFunc = func(*jwt.Token) (any, error) { return conf.HMACSecret, nil }
+	case len(conf.HMACSecret) == 0 && conf.JWKS != nil:
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA", "HS256", "HS384", "HS512"}
+		keyFunc = conf.JWKS.key
+	default:
+		return nil, fmt.Errorf("exactly one of an HMAC secret and a JWKS is required")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if conf.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(conf.Issuer))
+	}
+
+	if conf.Audience != "" {
+		opts = append(opts, jwt.WithAudience(conf.Audience))
+	}
+	return &JWTAuthenticator{keyFunc: keyFunc, parser: jwt.NewParser(opts...)}, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	claims := &tokenClaims{}
+	if _, err := a.parser.ParseWithClaims(raw, claims, a.keyFunc); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("invalid token: the subject is required")
+	}
+	return &Principal{Name: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// JWKS is a set of JSON Web Keys (RFC 7517) verifying the signature of tokens.
+type JWKS struct {
+	keys []jsonWebKey
+}
+
+type jsonWebKey struct {
+	kid string
+	alg string
+	key any
+}
+
+// LoadJWKS reads the JSON Web Key Set held by the file with the given name. RSA, EC (P-256, P-384 and P-521),
+// Ed25519 and symmetric keys are supported.
+func LoadJWKS(name string) (*JWKS, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS parses a JSON Web Key Set.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	jwks := &JWKS{}
+	for i, k := range set.Keys {
+		// keys reserved for encryption are not used to verify signatures
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJWK(k.Kty, k.N, k.E, k.Crv, k.X, k.Y, k.K)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS: key %d: %w", i+1, err)
+		}
+		jwks.keys = append(jwks.keys, jsonWebKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+
+	if len(jwks.keys) == 0 {
+		return nil, fmt.Errorf("invalid JWKS: no signature keys")
+	}
+	return jwks, nil
+}
+
+func parseJWK(kty, n, e, crv, x, y, k string) (crypto.PublicKey, error) {
+	decode := func(field, value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid %q parameter", field)
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	switch kty {
+	case "RSA":
+		modulus, err := decode("n", n)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent, err := decode("e", e)
+		if err != nil || !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid %q parameter", "e")
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", crv)
+		}
+
+		px, err := decode("x", x)
+		if err != nil {
+			return nil, err
+		}
+
+		py, err := decode("y", y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(px, py) {
+			return nil, fmt.Errorf("the point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: px, Y: py}, nil
+	case "OKP":
+		if crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", crv)
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(x)
+		if err != nil || len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid %q parameter", "x")
+		}
+		return ed25519.PublicKey(data), nil
+	case "oct":
+		data, err := base64.RawURLEncoding.DecodeString(k)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid %q parameter", "k")
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", kty)
+}
+
+// key returns the key verifying token. Tokens without a "kid" header are accepted if the set holds a single key.
+func (s *JWKS) key(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, k := range s.keys {
+		if (k.kid == kid || (kid == "" && len(s.keys) == 1)) && (k.alg == "" || k.alg == token.Method.Alg()) {
+			return k.key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key matches the token")
+}
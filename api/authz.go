@@ -0,0 +1,397 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ostafen/demo/model"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Access is a level of access to answers. Each level includes the lower ones.
+type Access int
+
+const (
+	NoAccess Access = iota
+	// ReadAccess allows to read answers and their history.
+	ReadAccess
+	// WriteAccess allows to create, update, delete and restore answers.
+	WriteAccess
+	// AdminAccess allows to erase answers and, when granted on all the keys, to back up the storage.
+	AdminAccess
+)
+
+var accessNames = []string{"none", "read", "write", "admin"}
+
+func (a Access) String() string {
+	if a < 0 || int(a) >= len(accessNames) {
+		return strconv.Itoa(int(a))
+	}
+	return accessNames[a]
+}
+
+func (a Access) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Access) UnmarshalText(text []byte) error {
+	for i, name := range accessNames {
+		if name == string(text) {
+			*a = Access(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown access %q (expected read, write or admin)", text)
+}
+
+// Scope is the set of answers accessed by a request: either a single key, or all the keys starting with a prefix.
+type Scope struct {
+	Key    string
+	Prefix bool
+	// Tenant owns the answers, or is empty for the answers of the default storage.
+	Tenant string
+}
+
+// KeyScope is the scope of the answer with the given key.
+func KeyScope(key string) Scope {
+	return Scope{Key: key}
+}
+
+// PrefixScope is the scope of the answers whose key starts with prefix.
+func PrefixScope(prefix string) Scope {
+	return Scope{Key: prefix, Prefix: true}
+}
+
+func (s Scope) String() string {
+	var keys string
+	switch {
+	case s.Prefix && s.Key == "":
+		keys = "all keys"
+	case s.Prefix:
+		keys = fmt.Sprintf("keys starting with %q", s.Key)
+	default:
+		keys = fmt.Sprintf("key %q", s.Key)
+	}
+
+	if s.Tenant != "" {
+		return fmt.Sprintf("%s of tenant %q", keys, s.Tenant)
+	}
+	return keys
+}
+
+// ErrForbidden is wrapped by the errors of an Authorizer denying access.
+var ErrForbidden = errors.New("forbidden")
+
+// Authorizer decides whether a principal is granted access to a scope.
+type Authorizer interface {
+	// Authorize returns an error wrapping ErrForbidden, and explaining why access is denied, or nil if it is granted.
+	// The principal is nil for anonymous requests.
+	Authorize(p *Principal, access Access, scope Scope) error
+}
+
+// WithAuthorizer checks the access of each request with a.
+// Otherwise, admin operations are allowed to principals with the admin role, and other operations to everyone.
+func WithAuthorizer(a Authorizer) ControllerOption {
+	return func(c *EventController) {
+		c.authorizer = a
+	}
+}
+
+// Policy grants access to answers by the prefix of their key. Access is denied unless granted by a rule.
+type Policy struct {
+	Rules []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// PolicyRule grants access to some keys to the principals with the given names or roles.
+// The "*" principal matches every request, anonymous ones included.
+// Keys are either exact keys or prefixes ending with "*", such as "team-a/*", while "*" matches all the keys.
+// The keys belong to the listed tenants ("*" for all of them), or to the default storage if no tenant is listed.
+type PolicyRule struct {
+	Principals []string `json:"principals,omitempty" yaml:"principals,omitempty"`
+	Roles      []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Tenants    []string `json:"tenants,omitempty" yaml:"tenants,omitempty"`
+	Keys       []string `json:"keys" yaml:"keys"`
+	Access     Access   `json:"access" yaml:"access"`
+}
+
+// ParsePolicy parses a policy in YAML or JSON format.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+
+	for i, rule := range p.Rules {
+		if len(rule.Principals) == 0 && len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("invalid policy: rule %d: no principals or roles", i+1)
+		}
+
+		if len(rule.Keys) == 0 {
+			return nil, fmt.Errorf("invalid policy: rule %d: no keys", i+1)
+		}
+
+		if rule.Access <= NoAccess || rule.Access > AdminAccess {
+			return nil, fmt.Errorf("invalid policy: rule %d: the access must be read, write or admin", i+1)
+		}
+	}
+	return p, nil
+}
+
+func (r *PolicyRule) matches(p *Principal) bool {
+	for _, name := range r.Principals {
+		if name == "*" || (p != nil && name == p.Name) {
+			return true
+		}
+	}
+
+	for _, role := range r.Roles {
+		if p != nil && p.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the keys of the rule include all the keys of scope.
+func (r *PolicyRule) covers(scope Scope) bool {
+	if !r.coversTenant(scope.Tenant) {
+		return false
+	}
+
+	for _, pattern := range r.Keys {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(scope.Key, prefix) {
+				return true
+			}
+		} else if !scope.Prefix && scope.Key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PolicyRule) coversTenant(tenant string) bool {
+	if len(r.Tenants) == 0 {
+		return tenant == ""
+	}
+
+	for _, t := range r.Tenants {
+		if t == tenant || (t == "*" && tenant != "") {
+			return true
+		}
+	}
+	return false
+}
+
+func (pol *Policy) Authorize(p *Principal, access Access, scope Scope) error {
+	granted := NoAccess
+	for i := range pol.Rules {
+		rule := &pol.Rules[i]
+		if rule.Access > granted && rule.matches(p) && rule.covers(scope) {
+			granted = rule.Access
+		}
+	}
+
+	if granted >= access {
+		return nil
+	}
+
+	who := "anonymous requests have"
+	if p != nil {
+		who = fmt.Sprintf("principal %q has", p.Name)
+	}
+
+	if granted == NoAccess {
+		return fmt.Errorf("%w: %s no access to %s", ErrForbidden, who, scope)
+	}
+	return fmt.Errorf("%w: %s %s access to %s, but %s access is required", ErrForbidden, who, granted, scope, access)
+}
+
+// PolicyFile is a policy loaded from a file, which can be reloaded when the file changes.
+type PolicyFile struct {
+	name   string
+	policy atomic.Value
+
+	mu    sync.Mutex
+	stamp fileStamp
+}
+
+// LoadPolicyFile loads the policy held by the file with the given name.
+func LoadPolicyFile(name string) (*PolicyFile, error) {
+	f := &PolicyFile{name: name}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload loads the policy again if the file has changed, and reports whether it has been reloaded.
+// If the new policy is invalid, the previous one is kept.
+func (f *PolicyFile) Reload() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stamp, err := statFile(f.name)
+	if err != nil {
+		return false, err
+	}
+
+	if f.policy.Load() != nil && stamp.equal(f.stamp) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.name)
+	if err != nil {
+		return false, err
+	}
+
+	// the file is marked as loaded even if invalid, so that the error is reported once per change
+	f.stamp = stamp
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return false, err
+	}
+
+	f.policy.Store(policy)
+	return true, nil
+}
+
+// Watch reloads the policy at every interval, until ctx is cancelled. The outcome of each reload of a changed file
+// is reported to onReload.
+func (f *PolicyFile) Watch(ctx context.Context, interval time.Duration, onReload func(err error)) {
+	watch(ctx, interval, f.Reload, onReload)
+}
+
+func (f *PolicyFile) Authorize(p *Principal, access Access, scope Scope) error {
+	return f.policy.Load().(*Policy).Authorize(p, access, scope)
+}
+
+// permission is the access to a scope required by a request.
+type permission struct {
+	access Access
+	scope  Scope
+}
+
+// permissionsFunc returns the permissions required by a request.
+type permissionsFunc func(ctx *gin.Context) ([]permission, error)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// authorize returns the middleware checking that the principal of the request has been granted the permissions
+// returned by required. Without an authorizer, only admin access is checked, by the role of the principal.
+func (c *EventController) authorize(required permissionsFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		permissions, err := required(ctx)
+		if err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		for _, perm := range permissions {
+			if c.authorizer == nil {
+				if perm.access == AdminAccess && !c.authorizeAdmin(ctx) {
+					return
+				}
+				continue
+			}
+
+			perm.scope.Tenant = ctx.GetString(TenantKey)
+			if err := c.authorizer.Authorize(principal(ctx), perm.access, perm.scope); err != nil {
+				ctx.Error(err)
+				ctx.AbortWithStatusJSON(http.StatusForbidden, errorResponse{Error: err.Error()})
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// onKey requires access to the answer identified by the key path parameter.
+func onKey(access Access) permissionsFunc {
+	return func(ctx *gin.Context) ([]permission, error) {
+		return []permission{{access, KeyScope(ctx.Param("key"))}}, nil
+	}
+}
+
+// onAllKeys requires access to all the answers.
+func onAllKeys(access Access) permissionsFunc {
+	return func(ctx *gin.Context) ([]permission, error) {
+		return []permission{{access, PrefixScope("")}}, nil
+	}
+}
+
+// onListedKeys requires read access to the answers whose key starts with the prefix query parameter.
+func onListedKeys(ctx *gin.Context) ([]permission, error) {
+	return []permission{{ReadAccess, PrefixScope(ctx.Query("prefix"))}}, nil
+}
+
+// onDeletedKey requires write access to a deleted answer, or admin access to an erased one.
+func onDeletedKey(ctx *gin.Context) ([]permission, error) {
+	access := WriteAccess
+	if purge, err := strconv.ParseBool(ctx.Query("purge")); err == nil && purge {
+		access = AdminAccess
+	}
+	return []permission{{access, KeyScope(ctx.Param("key"))}}, nil
+}
+
+// peekBody decodes the JSON body of the request into v, and restores the body for the handler.
+func peekBody(ctx *gin.Context, v any) error {
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return err
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// onBodyKey requires access to the answer given by the JSON body of the request.
+func onBodyKey(access Access) permissionsFunc {
+	return func(ctx *gin.Context) ([]permission, error) {
+		var answ model.Answer
+		if err := peekBody(ctx, &answ); err != nil {
+			return nil, err
+		}
+		return []permission{{access, KeyScope(answ.Key)}}, nil
+	}
+}
+
+// onBatchKeys requires write access to the answers modified by a batch. Other actions are left to the handler.
+func onBatchKeys(ctx *gin.Context) ([]permission, error) {
+	if ctx.Param("action") != ":batch" {
+		return nil, nil
+	}
+
+	var req batchRequest
+	if err := peekBody(ctx, &req); err != nil {
+		return nil, err
+	}
+
+	permissions := make([]permission, len(req.Operations))
+	for i, op := range req.Operations {
+		permissions[i] = permission{WriteAccess, KeyScope(op.Key)}
+	}
+	return permissions, nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+
+	"github.com/ostafen/demo/model"
+	"github.com/ostafen/demo/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxBatchSize = 1000
+
+type batchOperation struct {
+	Op    model.EventType `json:"op" validate:"required,oneof=create update delete"`
+	Key   string          `json:"key" validate:"required"`
+	Value string          `json:"value" validate:"required_unless=Op delete"`
+	// Version is the version the answer is expected to have before the operation is applied (0 disables the check).
+	Version int64 `json:"version" validate:"min=0"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations" validate:"required,min=1,dive"`
+}
+
+type batchResult struct {
+	Status  int    `json:"status"`
+	Version int64  `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+func operationStatus(op model.EventType, err error) int {
+	switch err {
+	case nil:
+		if op == model.CreateEvent {
+			return http.StatusCreated
+		}
+		return http.StatusOK
+	case store.ErrAnswerExist:
+		return http.StatusConflict
+	case store.ErrAnswerNotExist:
+		return http.StatusNotFound
+	case store.ErrVersionMismatch:
+		return http.StatusPreconditionFailed
+	case store.ErrBatchAborted:
+		return http.StatusFailedDependency
+	}
+	return http.StatusBadRequest
+}
+
+// ApplyBatch atomically executes a batch of creates, updates and deletes.
+// The response reports the outcome of each operation: if any of them fails, none is applied
+// and the request fails with status 409.
+func (c *EventController) ApplyBatch(ctx *gin.Context) {
+	var req batchRequest
+
+	if err := ctx.BindJSON(&req); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	v := validator.New()
+	if err := v.Struct(req); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Operations) > maxBatchSize {
+		ctx.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ops := make([]store.Operation, len(req.Operations))
+	for i, op := range req.Operations {
+		ops[i] = store.Operation{
+			Type:            op.Op,
+			Answer:          &model.Answer{Key: op.Key, Value: op.Value},
+			ExpectedVersion: op.Version,
+		}
+	}
+
+	results, err := c.storage(ctx).ApplyContext(ctx.Request.Context(), ops, writeOptions(ctx)...)
+	if err != nil && err != store.ErrBatchAborted {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := batchResponse{Results: make([]batchResult, len(results))}
+	for i, res := range results {
+		resp.Results[i] = batchResult{
+			Status:  operationStatus(ops[i].Type, res.Err),
+			Version: res.Version,
+		}
+
+		if res.Err != nil {
+			resp.Results[i].Error = res.Err.Error()
+		}
+	}
+
+	status := http.StatusOK
+	if err == store.ErrBatchAborted {
+		status = http.StatusConflict
+	}
+	ctx.JSON(status, resp)
+}
+
+// answersAction dispatches custom methods on the answers collection, such as POST /answers:batch.
+func (c *EventController) answersAction(ctx *gin.Context) {
+	switch ctx.Param("action") {
+	case ":batch":
+		c.ApplyBatch(ctx)
+	default:
+		ctx.AbortWithStatus(http.StatusNotFound)
+	}
+}
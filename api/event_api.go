@@ -3,7 +3,13 @@ package api
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 
@@ -15,12 +21,57 @@ import (
 
 type EventController struct {
 	store store.EventStore
+	// adminToken, if not empty, authenticates its bearer as an admin.
+	adminToken     string
+	authenticators []Authenticator
+	authorizer     Authorizer
+	tenants        *store.Tenants
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ControllerOption customizes an EventController.
+type ControllerOption func(*EventController)
+
+// WithAdminToken authenticates requests carrying the given token in an "Authorization: Bearer" header as an admin,
+// allowed to perform admin operations, such as backups and erasures.
+func WithAdminToken(token string) ControllerOption {
+	return func(c *EventController) {
+		c.adminToken = token
+	}
 }
 
-func NewEventController(store store.EventStore) *EventController {
-	return &EventController{
+func NewEventController(store store.EventStore, opts ...ControllerOption) *EventController {
+	c := &EventController{
 		store: store,
+		done:  make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Shutdown terminates the live event streams served by the controller.
+// Since http.Server.Shutdown waits for active requests to complete, it should be registered with RegisterOnShutdown.
+func (c *EventController) Shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// ActorKey is the key of the gin context value holding the name of the principal on behalf of which the request is performed.
+const ActorKey = "actor"
+
+// writeOptions attaches the actor and the request metadata to the event recorded by a write operation.
+func writeOptions(ctx *gin.Context, opts ...store.WriteOption) []store.WriteOption {
+	metadata := map[string]string{"client_ip": ctx.ClientIP()}
+	if requestID := ctx.GetHeader("X-Request-ID"); requestID != "" {
+		metadata["request_id"] = requestID
 	}
+	return append(opts, store.WithActor(ctx.GetString(ActorKey)), store.WithMetadata(metadata))
 }
 
 func (c *EventController) CreateAnswer(ctx *gin.Context) {
@@ -37,7 +88,7 @@ func (c *EventController) CreateAnswer(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.store.Create(&answ); err != nil {
+	if err := c.storage(ctx).CreateContext(ctx.Request.Context(), &answ, writeOptions(ctx)...); err != nil {
 		if err == store.ErrAnswerExist {
 			ctx.AbortWithError(http.StatusConflict, err)
 		} else {
@@ -45,15 +96,61 @@ func (c *EventController) CreateAnswer(ctx *gin.Context) {
 		}
 		return
 	}
+
+	ctx.Header("ETag", etag(answ.Version))
 	ctx.IndentedJSON(http.StatusCreated, answ)
 }
 
+var errInvalidIfMatch = errors.New("invalid If-Match header")
+
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// expectedVersion extracts the version the client expects the answer to have from the If-Match header.
+// A missing header (or a "*" value) disables the optimistic concurrency check.
+func expectedVersion(ctx *gin.Context) (int64, error) {
+	tag := strings.TrimPrefix(strings.TrimSpace(ctx.GetHeader("If-Match")), "W/")
+	if tag == "" || tag == "*" {
+		return store.AnyVersion, nil
+	}
+
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, errInvalidIfMatch
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, errInvalidIfMatch
+	}
+	return version, nil
+}
+
 func (c *EventController) DeleteAnswer(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	if err := c.store.Delete(key); err != nil {
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if purge := ctx.Query("purge"); purge != "" {
+		if erase, err := strconv.ParseBool(purge); err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("purge must be a boolean"))
+			return
+		} else if erase {
+			c.EraseAnswer(ctx, key, version)
+			return
+		}
+	}
+
+	if err := c.storage(ctx).DeleteContext(ctx.Request.Context(), key, writeOptions(ctx, store.WithExpectedVersion(version))...); err != nil {
 		if err == store.ErrAnswerNotExist {
 			ctx.AbortWithError(http.StatusNoContent, err)
+		} else if err == store.ErrVersionMismatch {
+			ctx.AbortWithError(http.StatusPreconditionFailed, err)
 		} else {
 			ctx.AbortWithError(http.StatusInternalServerError, err)
 		}
@@ -61,24 +158,160 @@ func (c *EventController) DeleteAnswer(ctx *gin.Context) {
 	}
 }
 
+const (
+	maxPageSize = 1000
+
+	// NextCursorHeader holds the cursor to retrieve the next page of a listing (the "after" parameter of
+	// the history endpoint, the "from" parameter of the global feed or the "cursor" parameter of the answer list).
+	// It is only set when more results are available.
+	NextCursorHeader = "X-Next-Cursor"
+)
+
+var errInvalidHistoryQuery = errors.New("invalid history query parameters")
+
+func parseHistoryOptions(ctx *gin.Context) (store.HistoryOptions, error) {
+	var opts store.HistoryOptions
+	var err error
+
+	if after := ctx.Query("after"); after != "" {
+		if opts.After, err = strconv.ParseInt(after, 10, 64); err != nil || opts.After < 0 {
+			return opts, fmt.Errorf("%w: after must be a sequence number", errInvalidHistoryQuery)
+		}
+	}
+
+	if limit := ctx.Query("limit"); limit != "" {
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit <= 0 || opts.Limit > maxPageSize {
+			return opts, fmt.Errorf("%w: limit must be between 1 and %d", errInvalidHistoryQuery, maxPageSize)
+		}
+	}
+
+	for _, t := range ctx.QueryArray("type") {
+		switch evt := model.EventType(t); evt {
+		case model.CreateEvent, model.UpdateEvent, model.DeleteEvent, model.RestoreEvent, model.SnapshotEvent, model.EraseEvent:
+			opts.Types = append(opts.Types, evt)
+		default:
+			return opts, fmt.Errorf("%w: unknown event type %q", errInvalidHistoryQuery, t)
+		}
+	}
+
+	if from := ctx.Query("from"); from != "" {
+		if opts.From, err = time.Parse(time.RFC3339Nano, from); err != nil {
+			return opts, fmt.Errorf("%w: from must be an RFC 3339 timestamp", errInvalidHistoryQuery)
+		}
+	}
+
+	if to := ctx.Query("to"); to != "" {
+		if opts.To, err = time.Parse(time.RFC3339Nano, to); err != nil {
+			return opts, fmt.Errorf("%w: to must be an RFC 3339 timestamp", errInvalidHistoryQuery)
+		}
+	}
+
+	switch ctx.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("%w: order must be either asc or desc", errInvalidHistoryQuery)
+	}
+	return opts, nil
+}
+
 func (c *EventController) GetHistory(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	writer := bufio.NewWriter(ctx.Writer)
+	opts, err := parseHistoryOptions(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	// without an explicit limit, the whole history is streamed to the client
+	if opts.Limit == 0 {
+		it, err := c.storage(ctx).QueryHistoryContext(ctx.Request.Context(), key, opts)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		defer it.Close()
+
+		c.streamEvents(ctx, it)
+		return
+	}
+
+	// fetch one more event than requested, to find out whether a next page exists
+	limit := opts.Limit
+	opts.Limit++
+
+	it, err := c.storage(ctx).QueryHistoryContext(ctx.Request.Context(), key, opts)
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer it.Close()
+
+	c.writePage(ctx, it, limit, func(last *model.Event) int64 { return last.ID })
+}
+
+const defaultPageSize = 100
+
+// ReadAll pages through the events of all the answers in commit order.
+func (c *EventController) ReadAll(ctx *gin.Context) {
+	from, err := strconv.ParseInt(ctx.DefaultQuery("from", "1"), 10, 64)
+	if err != nil || from < 0 {
+		ctx.AbortWithError(http.StatusBadRequest, errors.New("from must be a sequence number"))
+		return
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxPageSize))
+		return
+	}
 
-	it, err := c.store.GetHistory(key)
+	it, err := c.storage(ctx).ReadAllContext(ctx.Request.Context(), from, limit+1)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 	defer it.Close()
 
+	c.writePage(ctx, it, limit, func(last *model.Event) int64 { return last.ID + 1 })
+}
+
+func (c *EventController) streamEvents(ctx *gin.Context, it store.EventIterator) {
+	writer := bufio.NewWriter(ctx.Writer)
+
 	ctx.Header("Content-Type", "application/json")
 	if err := c.writeEvents(writer, it); err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err)
 	}
 }
 
+// writePage sends at most limit events read from it. If more events are available,
+// the NextCursorHeader is set to the value returned by cursor for the last event of the page.
+func (c *EventController) writePage(ctx *gin.Context, it store.EventIterator, limit int, cursor func(last *model.Event) int64) {
+	events := make([]*model.Event, 0, limit)
+	for it.Next() {
+		e, err := it.Value()
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if len(events) == limit {
+			ctx.Header(NextCursorHeader, strconv.FormatInt(cursor(events[limit-1]), 10))
+			break
+		}
+		events = append(events, e)
+	}
+
+	if err := it.Err(); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, events)
+}
+
 func (c *EventController) writeEvents(writer *bufio.Writer, it store.EventIterator) error {
 	if _, err := writer.WriteString("["); err != nil {
 		return err
@@ -107,6 +340,11 @@ func (c *EventController) writeEvents(writer *bufio.Writer, it store.EventIterat
 		}
 	}
 
+	// do not terminate the array if the iteration has been interrupted, so that clients detect the truncation
+	if err := it.Err(); err != nil {
+		return err
+	}
+
 	_, err := writer.WriteString("]")
 	if err != nil {
 		return err
@@ -114,10 +352,38 @@ func (c *EventController) writeEvents(writer *bufio.Writer, it store.EventIterat
 	return writer.Flush()
 }
 
+var errInvalidAsOf = errors.New("asOf must be either an event sequence number or an RFC 3339 timestamp")
+
+// parseAsOf interprets the value of the asOf query parameter.
+func parseAsOf(value string) (store.AsOf, error) {
+	if value == "" {
+		return store.AsOf{}, nil
+	}
+
+	if seq, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seq <= 0 {
+			return store.AsOf{}, errInvalidAsOf
+		}
+		return store.AtSequence(seq), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return store.AsOf{}, errInvalidAsOf
+	}
+	return store.AtTime(t), nil
+}
+
 func (c *EventController) GetAnswer(ctx *gin.Context) {
 	key := ctx.Param("key")
 
-	answ, err := c.store.GetAnswer(key)
+	asOf, err := parseAsOf(ctx.Query("asOf"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	answ, err := c.storage(ctx).GetAnswerAtContext(ctx.Request.Context(), key, asOf)
 	if err != nil {
 		if err == store.ErrAnswerNotExist {
 			ctx.AbortWithError(http.StatusNotFound, err)
@@ -127,9 +393,71 @@ func (c *EventController) GetAnswer(ctx *gin.Context) {
 		return
 	}
 
+	tag := etag(answ.Version)
+	ctx.Header("ETag", tag)
+
+	if ctx.GetHeader("If-None-Match") == tag {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
 	ctx.JSON(http.StatusOK, answ)
 }
 
+func parseListOptions(ctx *gin.Context) (store.ListOptions, error) {
+	opts := store.ListOptions{
+		Prefix: ctx.Query("prefix"),
+		Query:  ctx.Query("q"),
+		Cursor: ctx.Query("cursor"),
+	}
+
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		return opts, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	opts.Limit = limit
+
+	switch sortBy := store.SortField(ctx.DefaultQuery("sort", string(store.SortByKey))); sortBy {
+	case store.SortByKey, store.SortByUpdate:
+		opts.SortBy = sortBy
+	default:
+		return opts, fmt.Errorf("sort must be either %s or %s", store.SortByKey, store.SortByUpdate)
+	}
+
+	switch ctx.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, errors.New("order must be either asc or desc")
+	}
+	return opts, nil
+}
+
+// ListAnswers returns a page of the existing answers, optionally filtered by key prefix and value.
+func (c *EventController) ListAnswers(ctx *gin.Context) {
+	opts, err := parseListOptions(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	answers, cursor, err := c.storage(ctx).ListAnswersContext(ctx.Request.Context(), opts)
+	if err != nil {
+		if err == store.ErrInvalidCursor {
+			ctx.AbortWithError(http.StatusBadRequest, err)
+		} else {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if cursor != "" {
+		ctx.Header(NextCursorHeader, cursor)
+	}
+	ctx.JSON(http.StatusOK, answers)
+}
+
 func (c *EventController) UpdateAnswer(ctx *gin.Context) {
 	var answ model.Answer
 
@@ -144,23 +472,116 @@ func (c *EventController) UpdateAnswer(ctx *gin.Context) {
 		return
 	}
 
-	err := c.store.Update(&answ)
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	err = c.storage(ctx).UpdateContext(ctx.Request.Context(), &answ, writeOptions(ctx, store.WithExpectedVersion(version))...)
 	if err != nil {
 		if err == store.ErrAnswerNotExist {
 			ctx.AbortWithError(http.StatusNotFound, err)
+		} else if err == store.ErrVersionMismatch {
+			ctx.AbortWithError(http.StatusPreconditionFailed, err)
 		} else {
 			ctx.AbortWithError(http.StatusInternalServerError, err)
 		}
 		return
 	}
 
+	ctx.Header("ETag", etag(answ.Version))
 	ctx.JSON(http.StatusOK, answ)
 }
 
+type restoreRequest struct {
+	Version int64 `json:"version" validate:"required,min=1"`
+}
+
+// RestoreAnswer reinstates the value an answer had at a previous version, even if the answer has been deleted.
+func (c *EventController) RestoreAnswer(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	var req restoreRequest
+	if err := ctx.BindJSON(&req); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	v := validator.New()
+	if err := v.Struct(req); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	version, err := expectedVersion(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	answ, err := c.storage(ctx).RestoreContext(ctx.Request.Context(), key, req.Version, writeOptions(ctx, store.WithExpectedVersion(version))...)
+	if err != nil {
+		switch err {
+		case store.ErrAnswerNotExist, store.ErrVersionNotExist:
+			ctx.AbortWithError(http.StatusNotFound, err)
+		case store.ErrVersionNotRestorable:
+			ctx.AbortWithError(http.StatusUnprocessableEntity, err)
+		case store.ErrVersionMismatch:
+			ctx.AbortWithError(http.StatusPreconditionFailed, err)
+		default:
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	ctx.Header("ETag", etag(answ.Version))
+	ctx.JSON(http.StatusOK, answ)
+}
+
+// Register mounts the routes of the controller on engine, behind the authentication of requests.
+// Keys containing slashes are escaped in request paths, such as /answers/team-a%2Fquestion: engine must have
+// UseRawPath set for them to be routed.
 func (c *EventController) Register(engine *gin.Engine) {
-	engine.PUT("/answers", c.CreateAnswer)
-	engine.GET("/answers/:key", c.GetAnswer)
-	engine.POST("/answers", c.UpdateAnswer)
-	engine.DELETE("/answers/:key", c.DeleteAnswer)
-	engine.GET("/answers/:key/events", c.GetHistory)
+	engine.Use(c.authenticate)
+
+	c.registerAnswers(engine)
+	engine.POST("/admin/backup", c.authorize(onAllKeys(AdminAccess)), c.Backup)
+
+	if c.tenants == nil {
+		return
+	}
+
+	engine.POST("/tenants", c.authorize(onAllKeys(AdminAccess)), c.CreateTenant)
+	engine.GET("/tenants", c.authorize(onAllKeys(AdminAccess)), c.ListTenants)
+	engine.DELETE("/tenants/:tenant", c.authorize(onAllKeys(AdminAccess)), c.DeleteTenant)
+
+	// the storage of the tenant is only looked up once the request is authorized,
+	// so that unauthorized clients cannot find out which tenants exist
+	c.registerAnswers(engine.Group("/tenants/:tenant", c.scopeTenant), c.openTenant)
+}
+
+// registerAnswers registers the endpoints serving the answers of a storage. The handlers of resolve, if any,
+// are run before each endpoint, once the request has been authorized.
+func (c *EventController) registerAnswers(r gin.IRoutes, resolve ...gin.HandlerFunc) {
+	route := func(required permissionsFunc, handler gin.HandlerFunc) []gin.HandlerFunc {
+		handlers := append([]gin.HandlerFunc{c.authorize(required)}, resolve...)
+		return append(handlers, handler)
+	}
+
+	r.PUT("/answers", route(onBodyKey(WriteAccess), c.CreateAnswer)...)
+	r.GET("/answers", route(onListedKeys, c.ListAnswers)...)
+	r.GET("/answers/:key", route(onKey(ReadAccess), c.GetAnswer)...)
+	r.POST("/answers", route(onBodyKey(WriteAccess), c.UpdateAnswer)...)
+	// the router treats the ":batch" suffix of "/answers:batch" as a path parameter
+	r.POST("/answers:action", route(onBatchKeys, c.answersAction)...)
+	r.POST("/answers/:key/restore", route(onKey(WriteAccess), c.RestoreAnswer)...)
+	r.DELETE("/answers/:key", route(onDeletedKey, c.DeleteAnswer)...)
+	r.GET("/answers/:key/events", route(onKey(ReadAccess), c.GetHistory)...)
+	r.GET("/answers/:key/events/stream", route(onKey(ReadAccess), c.StreamHistory)...)
+	r.GET("/events", route(onAllKeys(ReadAccess), c.ReadAll)...)
+	r.GET("/events/stream", route(onAllKeys(ReadAccess), c.StreamEvents)...)
+	r.GET("/events/export", route(onAllKeys(ReadAccess), c.ExportEvents)...)
+	// imported events carry their own actor, timestamp and metadata, which would let writers forge the history
+	r.POST("/events/import", route(onAllKeys(AdminAccess), c.ImportEvents)...)
 }
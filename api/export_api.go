@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ostafen/demo/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Trailers of the response of ExportEvents, which report its outcome once the events have been streamed.
+const (
+	// ExportEventsTrailer holds the number of exported events, and is only sent if the export is complete.
+	ExportEventsTrailer = "X-Export-Events"
+	// ExportErrorTrailer holds the error which interrupted the export.
+	ExportErrorTrailer = "X-Export-Error"
+)
+
+// ExportEvents streams the whole event log as newline-delimited JSON, one event per line, in sequence order.
+// Since the status is sent before the events, a failure in the middle of the export is reported by the trailers:
+// clients must check the ExportEventsTrailer to detect a truncated export.
+func (c *EventController) ExportEvents(ctx *gin.Context) {
+	ctx.Header("Content-Type", "application/x-ndjson")
+	ctx.Header("Trailer", ExportEventsTrailer+", "+ExportErrorTrailer)
+
+	n, err := store.Export(ctx.Request.Context(), c.storage(ctx), ctx.Writer)
+	switch {
+	case err == nil:
+		ctx.Writer.Header().Set(ExportEventsTrailer, strconv.FormatInt(n, 10))
+	case !ctx.Writer.Written():
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+	default:
+		ctx.Error(err)
+		ctx.Writer.Header().Set(ExportErrorTrailer, err.Error())
+	}
+}
+
+type importResponse struct {
+	store.ImportResult
+	Error string `json:"error,omitempty"`
+}
+
+// ImportEvents records the events of the newline-delimited JSON body, in the format of ExportEvents, skipping
+// the ones which are already recorded. If the import fails, the response reports the events imported so far.
+func (c *EventController) ImportEvents(ctx *gin.Context) {
+	result, err := store.Import(ctx.Request.Context(), c.storage(ctx), ctx.Request.Body)
+
+	status := http.StatusOK
+	switch {
+	case err == nil:
+	case errors.Is(err, store.ErrInvalidEvent):
+		status = http.StatusBadRequest
+	case errors.Is(err, store.ErrEventConflict):
+		status = http.StatusConflict
+	default:
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := importResponse{ImportResult: result}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	ctx.JSON(status, resp)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// fileStamp identifies a version of a file by its modification time and size.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileStamp, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+func (s fileStamp) equal(other fileStamp) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
+}
+
+// watch calls reload at every interval, until ctx is cancelled. The outcome of each reload which has either
+// loaded changed files, or failed, is reported to onReload.
+func watch(ctx context.Context, interval time.Duration, reload func() (bool, error), onReload func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if reloaded, err := reload(); reloaded || err != nil {
+			onReload(err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ostafen/demo/model"
+	"github.com/ostafen/demo/store"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+var errInvalidFrom = errors.New("from must be a sequence number")
+
+// streamStart returns the sequence number of the first event to replay, and false if no replay has been requested.
+// When a client reconnects, the Last-Event-ID header takes precedence over the from parameter.
+func streamStart(ctx *gin.Context) (int64, bool, error) {
+	if lastID := ctx.GetHeader("Last-Event-ID"); lastID != "" {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || id < 0 {
+			return 0, false, errors.New("invalid Last-Event-ID header")
+		}
+		return id + 1, true, nil
+	}
+
+	from := ctx.Query("from")
+	if from == "" {
+		return 0, false, nil
+	}
+
+	seq, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false, errInvalidFrom
+	}
+	return seq, true, nil
+}
+
+// StreamEvents sends the events of all the answers as Server-Sent Events. If a starting sequence number is given,
+// past events are replayed before new ones are pushed as soon as they are committed.
+func (c *EventController) StreamEvents(ctx *gin.Context) {
+	c.stream(ctx, "", func(from int64) (store.EventIterator, error) {
+		return c.storage(ctx).ReadAllContext(ctx.Request.Context(), from, 0)
+	})
+}
+
+// StreamHistory behaves like StreamEvents, but only sends the events of a single answer.
+func (c *EventController) StreamHistory(ctx *gin.Context) {
+	key := ctx.Param("key")
+
+	c.stream(ctx, key, func(from int64) (store.EventIterator, error) {
+		return c.storage(ctx).QueryHistoryContext(ctx.Request.Context(), key, store.HistoryOptions{After: from - 1})
+	})
+}
+
+func (c *EventController) stream(ctx *gin.Context, key string, replay func(from int64) (store.EventIterator, error)) {
+	from, doReplay, err := streamStart(ctx)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	// subscribe before replaying, so that no event committed in the meantime is lost
+	sub := c.storage(ctx).Subscribe()
+	defer sub.Close()
+
+	var last int64
+	if doReplay {
+		it, err := replay(from)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		last, err = c.replayEvents(ctx, it)
+		it.Close()
+
+		if err != nil {
+			ctx.Error(err)
+			return
+		}
+	}
+
+	ctx.Writer.WriteHeaderNow()
+	ctx.Writer.Flush()
+
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-c.done:
+			return
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+
+			// skip events already sent during the replay, as well as events of other answers
+			if e.ID <= last || (key != "" && e.Data.Key != key) {
+				continue
+			}
+
+			if err := writeSSEvent(ctx, e); err != nil {
+				ctx.Error(err)
+				return
+			}
+			ctx.Writer.Flush()
+		}
+	}
+}
+
+func (c *EventController) replayEvents(ctx *gin.Context, it store.EventIterator) (int64, error) {
+	var last int64
+	for it.Next() {
+		e, err := it.Value()
+		if err != nil {
+			return last, err
+		}
+
+		if err := writeSSEvent(ctx, e); err != nil {
+			return last, err
+		}
+		last = e.ID
+	}
+	return last, it.Err()
+}
+
+func writeSSEvent(ctx *gin.Context, e *model.Event) error {
+	ctx.Render(-1, sse.Event{
+		Id:    strconv.FormatInt(e.ID, 10),
+		Event: string(e.Event),
+		Data:  e,
+	})
+	return ctx.Request.Context().Err()
+}
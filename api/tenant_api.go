@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+
+	"github.com/ostafen/demo/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TenantKey is the key of the gin context value holding the name of the tenant whose answers are accessed by
+// the request. It is empty for the answers of the default storage.
+const TenantKey = "tenant"
+
+// storeKey is the key of the gin context value holding the storage of the tenant of the request.
+const storeKey = "store"
+
+// WithTenants serves the answers of each tenant under /tenants/:tenant, from its own storage, and enables the
+// endpoints managing the tenants.
+func WithTenants(tenants *store.Tenants) ControllerOption {
+	return func(c *EventController) {
+		c.tenants = tenants
+	}
+}
+
+// storage returns the storage accessed by the request: the one of its tenant, if any, or the default one.
+func (c *EventController) storage(ctx *gin.Context) store.EventStore {
+	if s, ok := ctx.Get(storeKey); ok {
+		return s.(store.EventStore)
+	}
+	return c.store
+}
+
+// scopeTenant marks the request as accessing the answers of the tenant of its path, so that it is authorized
+// for that tenant.
+func (c *EventController) scopeTenant(ctx *gin.Context) {
+	ctx.Set(TenantKey, ctx.Param("tenant"))
+	ctx.Next()
+}
+
+// openTenant looks up the storage of the tenant of the request.
+func (c *EventController) openTenant(ctx *gin.Context) {
+	s, err := c.tenants.Get(ctx.Request.Context(), ctx.GetString(TenantKey))
+	if err != nil {
+		if err == store.ErrTenantNotExist {
+			ctx.AbortWithError(http.StatusNotFound, err)
+		} else {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	ctx.Set(storeKey, s)
+	ctx.Next()
+}
+
+type tenant struct {
+	Name string `json:"name" validate:"required"`
+}
+
+// CreateTenant creates a tenant with an empty storage.
+func (c *EventController) CreateTenant(ctx *gin.Context) {
+	var t tenant
+
+	if err := ctx.BindJSON(&t); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	v := validator.New()
+	if err := v.Struct(t); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := c.tenants.Create(ctx.Request.Context(), t.Name); err != nil {
+		switch err {
+		case store.ErrInvalidTenant:
+			ctx.AbortWithError(http.StatusBadRequest, err)
+		case store.ErrTenantExist:
+			ctx.AbortWithError(http.StatusConflict, err)
+		default:
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	ctx.JSON(http.StatusCreated, t)
+}
+
+// ListTenants returns the tenants in ascending order of name.
+func (c *EventController) ListTenants(ctx *gin.Context) {
+	names, err := c.tenants.List(ctx.Request.Context())
+	if err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	tenants := make([]tenant, len(names))
+	for i, name := range names {
+		tenants[i] = tenant{Name: name}
+	}
+	ctx.JSON(http.StatusOK, tenants)
+}
+
+// DeleteTenant permanently removes a tenant, together with all the events of its answers.
+func (c *EventController) DeleteTenant(ctx *gin.Context) {
+	if err := c.tenants.Delete(ctx.Request.Context(), ctx.Param("tenant")); err != nil {
+		if err == store.ErrTenantNotExist {
+			ctx.AbortWithError(http.StatusNotFound, err)
+		} else {
+			ctx.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Certificate is a TLS certificate loaded from a PEM encoded certificate chain and private key,
+// which can be reloaded when the files change, without restarting the server.
+type Certificate struct {
+	certFile, keyFile string
+	cert              atomic.Value
+
+	mu     sync.Mutex
+	stamps [2]fileStamp
+}
+
+// LoadCertificate loads the certificate chain and the private key held by the given files.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate again if its files have changed, and reports whether it has been reloaded.
+// If the new files are invalid, for example because only one of them has been replaced so far,
+// the previous certificate is kept.
+func (c *Certificate) Reload() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var stamps [2]fileStamp
+	for i, name := range []string{c.certFile, c.keyFile} {
+		stamp, err := statFile(name)
+		if err != nil {
+			return false, err
+		}
+		stamps[i] = stamp
+	}
+
+	if c.cert.Load() != nil && stamps[0].equal(c.stamps[0]) && stamps[1].equal(c.stamps[1]) {
+		return false, nil
+	}
+
+	// the files are marked as loaded even if invalid, so that the error is reported once per change
+	c.stamps = stamps
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.cert.Store(&cert)
+	return true, nil
+}
+
+// Watch reloads the certificate at every interval, until ctx is cancelled. The outcome of each reload of
+// changed files is reported to onReload.
+func (c *Certificate) Watch(ctx context.Context, interval time.Duration, onReload func(err error)) {
+	watch(ctx, interval, c.Reload, onReload)
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as the GetCertificate function
+// of a tls.Config.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load().(*tls.Certificate), nil
+}
+
+// NewTLSConfig returns the TLS configuration of a server presenting cert, and negotiating HTTP/2.
+// If clientCAFile is not empty, the certificates presented by clients must be signed by one of the PEM encoded
+// certificates it holds, and can be used to authenticate requests with ClientCertAuthenticator.
+func NewTLSConfig(cert *Certificate, clientCAFile string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if clientCAFile == "" {
+		return conf, nil
+	}
+
+	data, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.ClientCAs = x509.NewCertPool()
+	if !conf.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %s", clientCAFile)
+	}
+
+	// clients without a certificate can still authenticate by other means
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	return conf, nil
+}
+
+var errUnverifiedClientCert = errors.New("the client certificate has not been verified")
+
+// ClientCertAuthenticator authenticates requests by the client certificate verified during the TLS handshake.
+// The principal is the common name of the subject of the certificate, or the whole subject if it has no common name.
+// It has no roles: the subject is chosen by whoever requests the certificate, and its organizational units are not
+// meant to grant access, so principals authenticated by certificate are granted access by name in the policy.
+type ClientCertAuthenticator struct{}
+
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	// certificates are only verified if the server has been configured with client CAs
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, errUnverifiedClientCert
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+
+	name := subject.CommonName
+	if name == "" {
+		name = subject.String()
+	}
+	return &Principal{Name: name}, nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ostafen/demo/store"
+)
+
+// command is a maintenance task which is run instead of the server, as in "service <name> [flags]".
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]*command{
+	"rebuild": {
+		description: "recompute the current state of all answers by replaying the event log",
+		run:         runRebuild,
+	},
+	"migrate": {
+		description: "upgrade the schema of a SQL storage to the latest version (storages are also upgraded when opened)",
+		run:         runMigrate,
+	},
+	"convert": {
+		description: "copy the event log of a storage to another, empty, storage (e.g. from sqlite to the log format)",
+		run:         runConvert,
+	},
+	"backup": {
+		description: "write a consistent copy of a storage to a file, while the storage is in use",
+		run:         runBackup,
+	},
+	"restore": {
+		description: "check the integrity of a backup and restore it into a storage, which must not be in use",
+		run:         runRestore,
+	},
+	"compact": {
+		description: "remove the events which are not retained by the -retention-* flags, and report the reclaimed space",
+		run:         runCompact,
+	},
+	"export": {
+		description: "write the event log of a storage as newline-delimited JSON",
+		run:         runExport,
+	},
+	"config": {
+		description: "print the effective configuration of the server, given by the configuration file, the environment and the flags (\"config print\")",
+		run:         runConfig,
+	},
+	"import": {
+		description: "record the events of a newline-delimited JSON file, skipping the ones already recorded",
+		run:         runImport,
+	},
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(flag.CommandLine.Output(), "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n    \t%s\n", name, commands[name].description)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s:\n", os.Args[0], name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runRebuild(args []string) error {
+	fs := newFlagSet("rebuild")
+	storage := storageFlags(fs)
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	s, err := store.OpenURL(storagePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Rebuild()
+}
+
+func runConvert(args []string) error {
+	fs := newFlagSet("convert")
+	from := fs.String("from", storagePathDefault, "URL of the source storage")
+	to := fs.String("to", "", "URL of the destination storage")
+	fs.Parse(args)
+
+	if *to == "" {
+		return fmt.Errorf("the destination storage is required")
+	}
+
+	src, err := store.OpenURL(*from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := store.OpenURL(*to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	n, err := store.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("copied %d events\n", n)
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	storage := storageFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "print the pending migrations without applying them")
+	showStatus := fs.Bool("status", false, "print the applied and pending migrations")
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	if *showStatus || *dryRun {
+		status, err := store.GetSchemaStatus(storagePath)
+		if err != nil {
+			return err
+		}
+
+		if *showStatus {
+			printSchemaStatus(status)
+		}
+
+		if *dryRun {
+			for _, m := range status.Pending {
+				fmt.Printf("-- migration %d: %s\n%s\n", m.Version, m.Description, strings.TrimSpace(m.SQL))
+			}
+		}
+		return nil
+	}
+
+	applied, err := store.Migrate(storagePath)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range applied {
+		fmt.Printf("applied migration %d: %s\n", m.Version, m.Description)
+	}
+	fmt.Printf("schema is up to date\n")
+	return nil
+}
+
+func runBackup(args []string) error {
+	fs := newFlagSet("backup")
+	storage := storageFlags(fs)
+	out := fs.String("out", "", "path of the backup file")
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return fmt.Errorf("the backup file is required")
+	}
+
+	s, err := store.OpenURL(storagePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// write to a temporary file, so that an existing backup is not replaced by an incomplete one
+	tmp := *out + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = s.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, *out)
+}
+
+func runRestore(args []string) error {
+	fs := newFlagSet("restore")
+	storage := storageFlags(fs)
+	from := fs.String("from", "", "path of the backup file")
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	if *from == "" {
+		return fmt.Errorf("the backup file is required")
+	}
+
+	file, err := os.Open(*from)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := store.RestoreBackup(storagePath, file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %d events\n", n)
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := newFlagSet("export")
+	storage := storageFlags(fs)
+	out := fs.String("out", "-", "path of the exported file (- for the standard output)")
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	s, err := store.OpenURL(storagePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w := os.Stdout
+	if *out != "-" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	n, err := store.Export(context.Background(), s, w)
+	if err != nil {
+		return err
+	}
+
+	if err := w.Sync(); err != nil && *out != "-" {
+		return err
+	}
+
+	// the standard output may hold the exported events
+	fmt.Fprintf(os.Stderr, "exported %d events\n", n)
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := newFlagSet("import")
+	storage := storageFlags(fs)
+	from := fs.String("from", "-", "path of the file to import (- for the standard input)")
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	s, err := store.OpenURL(storagePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	r := os.Stdin
+	if *from != "-" {
+		if r, err = os.Open(*from); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+
+	result, err := store.Import(context.Background(), s, r)
+	fmt.Printf("imported %d events, skipped %d events already recorded\n", result.Imported, result.Skipped)
+	return err
+}
+
+func runCompact(args []string) error {
+	fs := newFlagSet("compact")
+	storage := storageFlags(fs)
+	policy := retentionFlags(fs)
+	if err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	storagePath, err := storage.url()
+	if err != nil {
+		return err
+	}
+
+	s, err := store.OpenURL(storagePath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	report, err := s.Compact(*policy)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("removed %d events, created %d snapshots, purged %d answers\n", report.RemovedEvents, report.Snapshots, report.PurgedAnswers)
+	fmt.Printf("reclaimed %d bytes\n", report.ReclaimedBytes)
+	return nil
+}
+
+func printSchemaStatus(status *store.SchemaStatus) {
+	fmt.Printf("schema version: %d\n", status.Version)
+
+	for _, m := range status.Applied {
+		appliedAt := "before versioning"
+		if !m.AppliedAt.IsZero() {
+			appliedAt = m.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("  applied  %4d  %-30s %s\n", m.Version, m.Description, appliedAt)
+	}
+
+	for _, m := range status.Pending {
+		fmt.Printf("  pending  %4d  %s\n", m.Version, m.Description)
+	}
+}
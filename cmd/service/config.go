@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ostafen/demo/store"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variables holding settings, such as DEMO_SQLITE_BUSY_TIMEOUT
+// for -sqlite-busy-timeout.
+const envPrefix = "DEMO_"
+
+// configFlag is the flag holding the path of the configuration file.
+const configFlag = "config"
+
+// configUsage is the usage of the config flag.
+const configUsage = "YAML, TOML or JSON configuration file, whose settings are overridden by " + envPrefix + "* environment variables and by flags"
+
+// redacted replaces the value of secret settings printed by "config print".
+const redacted = "REDACTED"
+
+// secretSettings are the settings whose value is redacted by "config print".
+var secretSettings = map[string]bool{
+	"admin-token": true,
+}
+
+// serverConfig holds the settings of the server.
+type serverConfig struct {
+	storagePath     string
+	listenAddr      string
+	adminToken      string
+	compactInterval time.Duration
+
+	auth      *authConfig
+	tls       *tlsConfig
+	sqlite    *store.Options
+	retention *store.RetentionPolicy
+}
+
+// serverFlags registers the flags of the server, which are the settings of the configuration file as well.
+func serverFlags(fs *flag.FlagSet) *serverConfig {
+	conf := &serverConfig{}
+	fs.String(configFlag, "", configUsage)
+	fs.StringVar(&conf.storagePath, "storage", storagePathDefault, storageUsage)
+	fs.StringVar(&conf.listenAddr, "host", addrDefault, "bind address of the server")
+	fs.StringVar(&conf.adminToken, "admin-token", "", "bearer token authenticating an admin, allowed to perform admin operations such as backups and erasures")
+	fs.DurationVar(&conf.compactInterval, "compact-interval", 0, "interval between compactions of the event log, according to the -retention-* flags (0 disables compactions)")
+	conf.auth = authFlags(fs)
+	conf.tls = tlsFlags(fs)
+	conf.sqlite = sqliteFlags(fs)
+	conf.retention = retentionFlags(fs)
+	return conf
+}
+
+// validate checks the consistency of the settings, and reports all the invalid ones.
+func (conf *serverConfig) validate() error {
+	var errs []string
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", setting, err))
+		}
+	}
+
+	if conf.storagePath == "" {
+		check("storage", fmt.Errorf("the storage URL is required"))
+	}
+
+	if conf.listenAddr == "" {
+		check("host", fmt.Errorf("the bind address is required"))
+	}
+
+	if conf.compactInterval < 0 {
+		check("compact-interval", fmt.Errorf("the interval cannot be negative"))
+	}
+
+	check("sqlite-*", conf.sqlite.Validate())
+	check("retention-*", conf.retention.Validate())
+	check("auth-*", conf.auth.validate())
+	check("tls-*", conf.tls.validate())
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// storageConfig holds the settings of the storage accessed by a maintenance command.
+type storageConfig struct {
+	storagePath string
+	sqlite      *store.Options
+}
+
+// storageFlags registers the flags of the storage accessed by a maintenance command. Like the ones of the server,
+// they can be set by the configuration file and by the environment, so that commands act on the configured storage.
+func storageFlags(fs *flag.FlagSet) *storageConfig {
+	conf := &storageConfig{}
+	fs.String(configFlag, "", configUsage)
+	fs.StringVar(&conf.storagePath, "storage", storagePathDefault, storageUsage)
+	conf.sqlite = sqliteFlags(fs)
+	return conf
+}
+
+// url returns the URL of the storage, tuned by the sqlite settings.
+func (conf *storageConfig) url() (string, error) {
+	if err := conf.sqlite.Validate(); err != nil {
+		return "", fmt.Errorf("invalid configuration: sqlite-*: %w", err)
+	}
+	return store.WithOptions(conf.storagePath, *conf.sqlite)
+}
+
+// envName returns the name of the environment variable holding the value of a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseConfig parses the command line arguments of fs. The flags which are not set by args are set, in order
+// of precedence, by the environment variables and by the configuration file given by the config flag, if any.
+// Only the settings of the server are read from the environment and the file, which can hold settings
+// not registered by fs, as when fs holds the flags of a maintenance command.
+func parseConfig(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	known := flag.NewFlagSet("settings", flag.ContinueOnError)
+	serverFlags(known)
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	configFile := fs.Lookup(configFlag).Value.String()
+	if value, ok := os.LookupEnv(envName(configFlag)); ok && !explicit[configFlag] {
+		configFile = value
+	}
+
+	var settings map[string]string
+	if configFile != "" {
+		var err error
+		if settings, err = readConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+
+	var errs []string
+	for name := range settings {
+		if known.Lookup(name) == nil || name == configFlag {
+			errs = append(errs, fmt.Sprintf("%s: unknown setting %q", configFile, name))
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || f.Name == configFlag || known.Lookup(f.Name) == nil {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid value %q: %v", envName(f.Name), value, err))
+			}
+		} else if value, ok := settings[f.Name]; ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s: invalid value %q: %v", configFile, f.Name, value, err))
+			}
+		}
+	})
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// readConfigFile reads the settings of a configuration file, in a format given by its extension. The settings are
+// named after the flags, and can be grouped by the prefix of their name: "auth: {jwt: {issuer: x}}" sets
+// -auth-jwt-issuer. Underscores are equivalent to hyphens.
+func readConfigFile(name string) (map[string]string, error) {
+	var unmarshal func([]byte, any) error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		unmarshal = yaml.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return nil, fmt.Errorf("unsupported format of configuration file %s (expected .yaml, .yml, .toml or .json)", name)
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]any)
+	if err := unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", name, err)
+	}
+
+	settings := make(map[string]string)
+	if err := flattenSettings(settings, "", tree); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", name, err)
+	}
+	return settings, nil
+}
+
+func flattenSettings(settings map[string]string, prefix string, tree map[string]any) error {
+	for key, value := range tree {
+		name := prefix + strings.ReplaceAll(key, "_", "-")
+
+		switch value := value.(type) {
+		case map[string]any:
+			if err := flattenSettings(settings, name+"-", value); err != nil {
+				return err
+			}
+		case string, bool, int, int64, uint64, float64:
+			if _, ok := settings[name]; ok {
+				return fmt.Errorf("%s is set twice", name)
+			}
+			settings[name] = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("%s must be a string, a number or a boolean", name)
+		}
+	}
+	return nil
+}
+
+// printConfig writes the settings of fs as a YAML configuration file, with the secrets redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	settings := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag {
+			return
+		}
+
+		value := f.Value.String()
+		switch {
+		case secretSettings[f.Name] && value != "":
+			settings[f.Name] = redacted
+		case f.Name == "storage":
+			settings[f.Name] = redactURL(value)
+		default:
+			// print booleans and numbers as such, but durations in their readable form
+			var typed any = value
+			if getter, ok := f.Value.(flag.Getter); ok {
+				typed = getter.Get()
+			}
+
+			if d, ok := typed.(time.Duration); ok {
+				typed = d.String()
+			}
+			settings[f.Name] = typed
+		}
+	})
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// runConfig prints the configuration which the server would run with, given the same arguments and environment.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: %s config print [flags]", os.Args[0])
+	}
+
+	fs := newFlagSet("config print")
+	conf := serverFlags(fs)
+	if err := parseConfig(fs, args[1:]); err != nil {
+		return err
+	}
+
+	if err := printConfig(os.Stdout, fs); err != nil {
+		return err
+	}
+	return conf.validate()
+}
@@ -1,6 +1,7 @@
 package model
 
 type Answer struct {
-	Key   string `json:"key" validate:"required"`
-	Value string `json:"value" validate:"required"`
+	Key     string `json:"key" validate:"required"`
+	Value   string `json:"value" validate:"required"`
+	Version int64  `json:"version,omitempty"`
 }
@@ -1,14 +1,28 @@
 package model
 
+import "time"
+
 type EventType string
 
 const (
 	CreateEvent EventType = "create"
 	UpdateEvent EventType = "update"
 	DeleteEvent EventType = "delete"
+	// RestoreEvent reinstates the value an answer had at a previous version.
+	RestoreEvent EventType = "restore"
+	// SnapshotEvent replaces the events removed from the history of an answer by a compaction,
+	// and holds the state they led the answer to.
+	SnapshotEvent EventType = "snapshot"
+	// EraseEvent records the erasure of the history of an answer, whose events have been permanently removed.
+	EraseEvent EventType = "erase"
 )
 
 type Event struct {
-	Event EventType `json:"event"`
-	Data  *Answer   `json:"data"`
+	ID        int64             `json:"id"`
+	Event     EventType         `json:"event"`
+	Version   int64             `json:"version"`
+	Timestamp time.Time         `json:"timestamp"`
+	Actor     string            `json:"actor,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Data      *Answer           `json:"data"`
 }
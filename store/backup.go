@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/ostafen/demo/model"
+)
+
+// ErrStorageInUse is returned when a storage which must not be in use, such as the storage replaced
+// by a backup, is open.
+var ErrStorageInUse = errors.New("the storage is in use")
+
+// sqliteHeader is the header of SQLite database files.
+const sqliteHeader = "SQLite format 3\x00"
+
+// openSQLiteBackup checks the integrity of the sqlite database located in dir, and opens it.
+// It is nil in builds without cgo.
+var openSQLiteBackup func(dir string) (EventStore, error)
+
+// lockSQLite takes an exclusive lock on the sqlite database located at dbPath, and returns the function releasing it.
+// It is nil in builds without cgo.
+var lockSQLite func(dbPath string) (release func() error, err error)
+
+// writeLog writes the events read from it in the format of the log of the file backend.
+func writeLog(w io.Writer, it EventIterator) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	batch := make([]*model.Event, 0, copyBatchSize)
+	for it.Next() {
+		e, err := it.Value()
+		if err != nil {
+			return err
+		}
+
+		if batch = append(batch, e); len(batch) == copyBatchSize {
+			if err := enc.Encode(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		if err := enc.Encode(batch); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// RestoreBackup restores the backup read from r, produced by EventStore.Backup, into the storage identified by rawURL,
+// and returns the number of restored events. The backup is checked for integrity before the storage is modified.
+//
+// A backup of a sqlite storage restored into a sqlite storage, or a backup of any other storage restored into a file
+// storage, replaces the database or log file of the storage, which must not be in use: the storage is locked during
+// the restore, which fails with ErrStorageInUse if it is open. Otherwise, the events of the backup are copied
+// to the storage, which must be empty.
+func RestoreBackup(rawURL string, r io.Reader) (int64, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(len(sqliteHeader))
+	isSQLite := string(header) == sqliteHeader
+
+	if isSQLite && openSQLiteBackup == nil {
+		return 0, fmt.Errorf("sqlite backups cannot be restored by builds without cgo")
+	}
+
+	replace := (isSQLite && u.Scheme == "sqlite") || (!isSQLite && u.Scheme == "file")
+	if replace {
+		release, err := lockStorage(u.Scheme, urlPath(u))
+		if err != nil {
+			return 0, err
+		}
+		defer release()
+	}
+
+	// stage the backup in the directory of the storage, so that it can be renamed over the file it replaces
+	stagingParent := ""
+	if u.Scheme == "sqlite" || u.Scheme == "file" {
+		stagingParent = urlPath(u)
+	}
+
+	staging, err := os.MkdirTemp(stagingParent, ".restore-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(staging)
+
+	filename := logFilename
+	if isSQLite {
+		filename = dbFilename
+	}
+
+	if err := writeFile(path.Join(staging, filename), br); err != nil {
+		return 0, err
+	}
+
+	src, err := openBackup(staging, isSQLite)
+	if err != nil {
+		return 0, fmt.Errorf("invalid backup: %w", err)
+	}
+	defer src.Close()
+
+	n, err := countEvents(src)
+	if err != nil {
+		return 0, fmt.Errorf("invalid backup: %w", err)
+	}
+
+	if replace {
+		if err := src.Close(); err != nil {
+			return 0, err
+		}
+		return n, replaceFile(path.Join(staging, filename), path.Join(urlPath(u), filename))
+	}
+
+	dst, err := OpenURL(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	return Copy(dst, src)
+}
+
+// lockStorage takes an exclusive lock on the sqlite or log storage located in dir, failing with ErrStorageInUse
+// if it is open, and returns the function releasing the lock.
+func lockStorage(scheme, dir string) (func() error, error) {
+	lock, err := lockFile(path.Join(dir, lockFilename), true)
+	if err != nil || scheme != "sqlite" {
+		return lock.Close, err
+	}
+
+	// the database may also be used without opening the storage, for example by the sqlite shell
+	unlockDB, err := lockSQLite(path.Join(dir, dbFilename))
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return func() error {
+		err := unlockDB()
+		if lockErr := lock.Close(); err == nil {
+			err = lockErr
+		}
+		return err
+	}, nil
+}
+
+func writeFile(name string, r io.Reader) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// openBackup checks the integrity of the backup staged in dir, and opens it.
+func openBackup(dir string, isSQLite bool) (EventStore, error) {
+	if isSQLite {
+		return openSQLiteBackup(dir)
+	}
+
+	// OpenLog discards an incomplete trailing line, which is a sign of a truncated backup
+	data, err := os.ReadFile(path.Join(dir, logFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		return nil, fmt.Errorf("the event log is truncated")
+	}
+	return OpenLog(dir)
+}
+
+func countEvents(s EventStore) (int64, error) {
+	it, err := s.ReadAll(1, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	var n int64
+	for it.Next() {
+		if _, err := it.Value(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, it.Err()
+}
+
+// replaceFile renames staged over name. The journal files of a sqlite database are removed as well,
+// since they must not be applied to the new database.
+func replaceFile(staged, name string) error {
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(name + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(staged, name)
+}
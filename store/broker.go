@@ -0,0 +1,99 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/ostafen/demo/model"
+)
+
+// subscriptionBufferSize is the maximum number of events which can be pending on a subscription.
+// Subscribers which fall further behind are dropped, and must subscribe again and replay the
+// events they missed from the log.
+const subscriptionBufferSize = 1024
+
+// Subscription delivers the events committed to the store after its creation, in commit order.
+type Subscription interface {
+	// Events returns the channel on which events are delivered.
+	// The channel is closed when the subscription is closed, or when the subscriber falls too far behind.
+	Events() <-chan *model.Event
+	Close()
+}
+
+type subscription struct {
+	b      *broker
+	events chan *model.Event
+}
+
+func (s *subscription) Events() <-chan *model.Event {
+	return s.events
+}
+
+func (s *subscription) Close() {
+	s.b.unsubscribe(s)
+}
+
+// broker fans out committed events to in-process subscribers.
+type broker struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{
+		subs: make(map[*subscription]struct{}),
+	}
+}
+
+func (b *broker) subscribe() Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &subscription{
+		b:      b,
+		events: make(chan *model.Event, subscriptionBufferSize),
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *broker) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+// publish delivers events to all the subscribers without blocking.
+func (b *broker) publish(events ...*model.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		for _, e := range events {
+			select {
+			case sub.events <- e:
+			default:
+				delete(b.subs, sub)
+				close(sub.events)
+			}
+
+			if _, ok := b.subs[sub]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// close terminates all the subscriptions.
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy selects the events removed by Compact. The last event of each answer is always kept,
+// as well as the last event of the log, so that sequence numbers are never reused.
+//
+// Removing events changes the result of point-in-time reads referring to them: an answer appears not to exist
+// before its oldest retained event, unless snapshots are enabled.
+type RetentionPolicy struct {
+	// KeepLast keeps the given number of most recent events of each answer. Zero disables the limit.
+	KeepLast int
+	// KeepFor keeps the events recorded within the given duration. Zero disables the limit.
+	// When both limits are set, events are kept if any of them retains them.
+	KeepFor time.Duration
+	// Snapshot replaces the removed events of each answer with a snapshot event, holding the state they led the answer to.
+	// The snapshot keeps the sequence number, version and timestamp of the last removed event.
+	Snapshot bool
+	// PurgeDeletedAfter removes the whole history of the answers which have been deleted for longer than the given duration.
+	// Zero disables purging.
+	PurgeDeletedAfter time.Duration
+	// Vacuum releases the space freed by the compaction to the file system, if the backend supports it.
+	Vacuum bool
+}
+
+// Validate checks that the limits of p are not negative.
+func (p RetentionPolicy) Validate() error {
+	if p.KeepLast < 0 || p.KeepFor < 0 || p.PurgeDeletedAfter < 0 {
+		return fmt.Errorf("retention limits cannot be negative")
+	}
+	return nil
+}
+
+// retains reports whether p retains the event at the given position of the history of its answer,
+// starting from 1 for the most recent event. Events with a zero timestamp, recorded before timestamps
+// were introduced, are older than any other event.
+func (p RetentionPolicy) retains(position int, timestamp, now time.Time) bool {
+	if position == 1 || (p.KeepLast == 0 && p.KeepFor == 0) {
+		return true
+	}
+	return (p.KeepLast > 0 && position <= p.KeepLast) || (p.KeepFor > 0 && !timestamp.Before(now.Add(-p.KeepFor)))
+}
+
+// CompactionReport describes the outcome of Compact.
+type CompactionReport struct {
+	// RemovedEvents is the number of removed events, including the ones of purged answers.
+	RemovedEvents int64
+	// Snapshots is the number of snapshot events created.
+	Snapshots int64
+	// PurgedAnswers is the number of deleted answers whose history has been removed.
+	PurgedAnswers int64
+	// ReclaimedBytes is the space released to the file system, if known.
+	ReclaimedBytes int64
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ostafen/demo/model"
+)
+
+var ErrNotEmpty = errors.New("the destination storage is not empty")
+
+// copyBatchSize is the number of events copied in a single transaction by Copy.
+const copyBatchSize = 1000
+
+// eventAppender is implemented by the stores which can record events produced by another store.
+type eventAppender interface {
+	// appendEvents records events, which must follow the last recorded event in sequence order,
+	// preserving their sequence number, timestamp and metadata.
+	appendEvents(ctx context.Context, events []*model.Event) error
+}
+
+func checkAppended(e *model.Event, lastID int64) error {
+	if e.Data == nil {
+		return fmt.Errorf("event %d has no data", e.ID)
+	}
+
+	if e.ID <= lastID {
+		return fmt.Errorf("event %d does not follow event %d", e.ID, lastID)
+	}
+	return nil
+}
+
+// Copy copies the whole event log of src to dst, which must be empty, preserving the sequence number, timestamp
+// and metadata of each event. It allows to migrate a storage to another backend. It returns the number of copied events.
+func Copy(dst, src EventStore) (int64, error) {
+	return CopyContext(context.Background(), dst, src)
+}
+
+// CopyContext is like Copy, but stops when ctx is cancelled. Events copied so far are kept.
+func CopyContext(ctx context.Context, dst, src EventStore) (int64, error) {
+	appender, ok := dst.(eventAppender)
+	if !ok {
+		return 0, fmt.Errorf("the destination storage does not support copies")
+	}
+
+	existing, err := readBatch(ctx, dst, 1, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(existing) > 0 {
+		return 0, ErrNotEmpty
+	}
+
+	var n int64
+	for from := int64(1); ; {
+		events, err := readBatch(ctx, src, from, copyBatchSize)
+		if err != nil || len(events) == 0 {
+			return n, err
+		}
+
+		if err := appender.appendEvents(ctx, events); err != nil {
+			return n, err
+		}
+
+		n += int64(len(events))
+		from = events[len(events)-1].ID + 1
+	}
+}
+
+func readBatch(ctx context.Context, s EventStore, from int64, limit int) ([]*model.Event, error) {
+	it, err := s.ReadAllContext(ctx, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	events := make([]*model.Event, 0, limit)
+	for it.Next() {
+		e, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, it.Err()
+}
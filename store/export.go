@@ -0,0 +1,188 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ostafen/demo/model"
+)
+
+// ErrInvalidEvent is returned by Import when the data to import is malformed.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// ErrEventConflict is returned by Import when an event differs from the one recorded with the same sequence number,
+// or would have to be recorded before the last recorded event.
+var ErrEventConflict = errors.New("the event conflicts with the events recorded by the storage")
+
+// maxLineSize is the maximum size of a line read by Import.
+const maxLineSize = 16 << 20
+
+// Export writes all the events of s to w as newline-delimited JSON, one event per line, in sequence order.
+// It returns the number of exported events.
+func Export(ctx context.Context, s EventStore, w io.Writer) (int64, error) {
+	it, err := s.ReadAllContext(ctx, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var n int64
+	for it.Next() {
+		e, err := it.Value()
+		if err != nil {
+			return n, err
+		}
+
+		if err := enc.Encode(e); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	if err := it.Err(); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// ImportResult reports the outcome of Import.
+type ImportResult struct {
+	// Imported is the number of events recorded by the storage.
+	Imported int64 `json:"imported"`
+	// Skipped is the number of events which were already recorded by the storage.
+	Skipped int64 `json:"skipped"`
+}
+
+// Import records the events read from r, in the format written by Export, preserving their sequence number,
+// timestamp and metadata. Import is idempotent: events which are already recorded, with the same sequence number
+// and content, are skipped, so that an interrupted import can be resumed by importing the same data again.
+// It fails with ErrEventConflict if an event differs from the recorded one, or does not follow the last recorded event.
+// Events are recorded in batches: those recorded before a failure are kept.
+func Import(ctx context.Context, s EventStore, r io.Reader) (ImportResult, error) {
+	appender, ok := s.(eventAppender)
+	if !ok {
+		return ImportResult{}, fmt.Errorf("the storage does not support imports")
+	}
+
+	im := &importer{ctx: ctx, s: s, appender: appender}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+
+	batch := make([]*model.Event, 0, copyBatchSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		e := &model.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return im.result, fmt.Errorf("%w at line %d: %v", ErrInvalidEvent, line, err)
+		}
+
+		if err := im.check(e); err != nil {
+			return im.result, fmt.Errorf("%w at line %d: %v", ErrInvalidEvent, line, err)
+		}
+
+		if batch = append(batch, e); len(batch) == copyBatchSize {
+			if err := im.flush(batch); err != nil {
+				return im.result, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return im.result, fmt.Errorf("%w: lines cannot exceed %d bytes", ErrInvalidEvent, maxLineSize)
+	} else if err != nil {
+		return im.result, err
+	}
+
+	if len(batch) > 0 {
+		if err := im.flush(batch); err != nil {
+			return im.result, err
+		}
+	}
+	return im.result, nil
+}
+
+type importer struct {
+	ctx      context.Context
+	s        EventStore
+	appender eventAppender
+
+	lastID int64
+	// appending is set once all the events recorded by the storage have been matched with imported ones.
+	appending bool
+	result    ImportResult
+}
+
+func (im *importer) check(e *model.Event) error {
+	switch e.Event {
+	case model.CreateEvent, model.UpdateEvent, model.DeleteEvent, model.RestoreEvent, model.SnapshotEvent, model.EraseEvent:
+	default:
+		return fmt.Errorf("invalid event type %q", e.Event)
+	}
+
+	if err := checkAppended(e, im.lastID); err != nil {
+		return err
+	}
+	im.lastID = e.ID
+	return nil
+}
+
+// flush records a batch of events, skipping the ones which are already recorded.
+func (im *importer) flush(batch []*model.Event) error {
+	if !im.appending {
+		recorded, err := readBatch(im.ctx, im.s, batch[0].ID, len(batch))
+		if err != nil {
+			return err
+		}
+
+		// both the batch and the recorded events are in sequence order, so they must match one to one
+		for _, e := range recorded {
+			if e.ID != batch[0].ID || !sameEvent(e, batch[0]) {
+				return fmt.Errorf("event %d: %w", batch[0].ID, ErrEventConflict)
+			}
+			batch = batch[1:]
+			im.result.Skipped++
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		// fewer recorded events than requested means that the last one has been reached
+		im.appending = true
+	}
+
+	if err := im.appender.appendEvents(im.ctx, batch); err != nil {
+		return err
+	}
+	im.result.Imported += int64(len(batch))
+	return nil
+}
+
+func sameEvent(a, b *model.Event) bool {
+	if a.Event != b.Event || a.Version != b.Version || a.Actor != b.Actor || !a.Timestamp.Equal(b.Timestamp) {
+		return false
+	}
+
+	if a.Data.Key != b.Data.Key || a.Data.Value != b.Data.Value || len(a.Metadata) != len(b.Metadata) {
+		return false
+	}
+
+	for k, v := range a.Metadata {
+		if bv, ok := b.Metadata[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
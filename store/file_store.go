@@ -0,0 +1,200 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/ostafen/demo/model"
+)
+
+const (
+	logFilename = "events.log"
+	// lockFilename is locked by the processes using a log or sqlite storage
+	lockFilename = "storage.lock"
+	// dbFilename is the database of the sqlite backend
+	dbFilename = "./data.mysqlite"
+)
+
+func init() {
+	Register("file", func(u *url.URL) (EventStore, error) {
+		return OpenLog(urlPath(u))
+	})
+}
+
+// fileStore persists the event log to an append-only file, where each line is the JSON array of the events committed by
+// a batch, and serves reads from memory. It does not depend on cgo, at the cost of loading the whole log at startup.
+// A log file cannot be opened by more than one process at a time: the storage is locked while open.
+type fileStore struct {
+	*memStore
+	file *os.File
+	lock *os.File
+}
+
+// OpenLog opens the log storage located in the given directory. It fails with ErrStorageInUse if the storage
+// is already open.
+func OpenLog(dir string) (EventStore, error) {
+	lock, err := lockFile(path.Join(dir, lockFilename), true)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path.Join(dir, logFilename), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	s := &fileStore{
+		memStore: newMemStore(),
+		file:     file,
+		lock:     lock,
+	}
+	s.memStore.persist = s.persist
+	s.memStore.rewrite = s.rewrite
+
+	if err := s.replay(); err != nil {
+		file.Close()
+		lock.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkNotSQLite fails if dir holds a sqlite database but no log, to avoid silently starting
+// from an empty log when a plain path, which used to refer to a sqlite storage, is opened by a build without cgo.
+func checkNotSQLite(dir string) error {
+	if _, err := os.Stat(path.Join(dir, logFilename)); !os.IsNotExist(err) {
+		return nil
+	}
+
+	if _, err := os.Stat(path.Join(dir, dbFilename)); err == nil {
+		return fmt.Errorf("%s contains a sqlite database: convert it with a cgo-enabled build, or pass a file:// URL to start from an empty log", dir)
+	}
+	return nil
+}
+
+// replay loads the events recorded in the log. A trailing incomplete line, left by a crash
+// in the middle of a write, belongs to a batch which has never been acknowledged, and is discarded.
+func (s *fileStore) replay() error {
+	r := bufio.NewReader(s.file)
+
+	var offset int64
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return s.truncate(offset)
+			}
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var events []*model.Event
+		if err := json.Unmarshal(line, &events); err != nil {
+			return fmt.Errorf("%s: line %d: %w", s.file.Name(), n, err)
+		}
+
+		for _, e := range events {
+			if e.Data == nil || e.ID <= s.lastID {
+				return fmt.Errorf("%s: line %d: invalid event", s.file.Name(), n)
+			}
+			s.append(e)
+		}
+		offset += int64(len(line))
+	}
+
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (s *fileStore) truncate(size int64) error {
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+
+	_, err := s.file.Seek(size, io.SeekStart)
+	return err
+}
+
+// persist appends a batch of events to the log, and waits for them to reach the disk.
+func (s *fileStore) persist(events []*model.Event) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(events); err != nil {
+		return err
+	}
+
+	offset, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(buf.Bytes())
+	if err == nil {
+		err = s.file.Sync()
+	}
+
+	if err != nil {
+		// do not leave a partial line in the middle of the log, nor a batch which has not been acknowledged
+		s.truncate(offset)
+	}
+	return err
+}
+
+// rewrite replaces the log with one holding the given events, and returns the difference of size between the two.
+// The new log is written to a temporary file, which is then renamed over the current one.
+func (s *fileStore) rewrite(events []*model.Event) (int64, error) {
+	name := s.file.Name()
+
+	size, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(name + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	var newSize int64
+	err = writeLog(file, &sliceIterator{ctx: context.Background(), events: events})
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err == nil {
+		newSize, err = file.Seek(0, io.SeekCurrent)
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), name)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	s.file.Close()
+	s.file = file
+	return size - newSize, nil
+}
+
+func (s *fileStore) Close() error {
+	s.memStore.Close()
+	err := s.file.Close()
+	if lockErr := s.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
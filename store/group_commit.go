@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/ostafen/demo/model"
+)
+
+// writeRequest is a batch of operations waiting to be committed together with the ones of other callers.
+type writeRequest struct {
+	ctx  context.Context
+	ops  []Operation
+	opts *writeOptions
+
+	events  []*model.Event
+	results []OperationResult
+	err     error
+	done    chan struct{}
+}
+
+// applyGrouped queues ops, and waits for them to be committed. The first caller acquiring writeMu commits
+// the requests queued so far in a single transaction, so that concurrent writers share the cost of a commit.
+func (s *storeImpl) applyGrouped(ctx context.Context, ops []Operation, o *writeOptions) ([]OperationResult, error) {
+	req := &writeRequest{ctx: ctx, ops: ops, opts: o, done: make(chan struct{})}
+
+	s.queueMu.Lock()
+	s.queue = append(s.queue, req)
+	s.queueMu.Unlock()
+
+	s.writeMu.Lock()
+	s.queueMu.Lock()
+	group := s.queue
+	s.queue = nil
+	s.queueMu.Unlock()
+
+	// group is empty if req has been committed by the previous holder of writeMu
+	if len(group) > 0 {
+		s.commitGroup(group)
+	}
+	s.writeMu.Unlock()
+
+	<-req.done
+	return req.results, req.err
+}
+
+// commitGroup applies each request of group in its own savepoint, so that a failed request
+// does not affect the others, and commits all of them at once. The caller must hold writeMu.
+func (s *storeImpl) commitGroup(group []*writeRequest) {
+	defer func() {
+		for _, req := range group {
+			close(req.done)
+		}
+	}()
+
+	// requests are applied with a context which is not cancelled, since a cancelled statement could abort the whole transaction
+	ctx := context.Background()
+
+	tx, err := s.beginWrite(ctx)
+	if err != nil {
+		for _, req := range group {
+			req.err = err
+		}
+		return
+	}
+	defer tx.Rollback()
+
+	committed := make([]*writeRequest, 0, len(group))
+	for _, req := range group {
+		if req.err = req.ctx.Err(); req.err != nil {
+			continue
+		}
+
+		req.results, req.err = s.applyRequest(ctx, req, tx)
+		if req.err == nil {
+			committed = append(committed, req)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		for _, req := range committed {
+			req.results, req.err = nil, err
+		}
+		return
+	}
+
+	for _, req := range committed {
+		for i := range req.ops {
+			*req.ops[i].Answer = *req.events[i].Data
+		}
+		s.broker.publish(req.events...)
+	}
+}
+
+// applyRequest applies the operations of req within a savepoint, which is rolled back if any of them fails.
+func (s *storeImpl) applyRequest(ctx context.Context, req *writeRequest, tx *sql.Tx) ([]OperationResult, error) {
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT request`); err != nil {
+		return nil, err
+	}
+
+	events, results, err := s.applyOperations(ctx, req.ops, req.opts, tx)
+	req.events = events
+	if err != nil {
+		if _, rollbackErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT request`); rollbackErr != nil {
+			return nil, fmt.Errorf("%v (rollback failed: %w)", err, rollbackErr)
+		}
+	}
+
+	if _, releaseErr := tx.ExecContext(ctx, `RELEASE SAVEPOINT request`); releaseErr != nil && err == nil {
+		return nil, releaseErr
+	}
+	return results, err
+}
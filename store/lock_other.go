@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package store
+
+import (
+	"os"
+)
+
+// lockFile opens the file with the given name, which is created if needed. Files are not locked on this platform.
+func lockFile(name string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes a lock on the file with the given name, which is created if needed, and returns it.
+// The lock is released when the file is closed. Shared locks can be held by several open files at once, while
+// an exclusive lock cannot: it fails with ErrStorageInUse if the file is locked by another open file,
+// of this process or of another one.
+func lockFile(name string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrStorageInUse
+		}
+		return nil, err
+	}
+	return file, nil
+}
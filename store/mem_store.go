@@ -0,0 +1,621 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ostafen/demo/model"
+)
+
+func init() {
+	Register("mem", func(u *url.URL) (EventStore, error) {
+		return OpenMemory(), nil
+	})
+}
+
+// memStore keeps the whole event log in memory. Events are never modified once recorded,
+// so they can be shared by readers after being copied out of the store.
+type memStore struct {
+	background
+
+	mu sync.RWMutex
+	// events holds all the events, in sequence order
+	events []*model.Event
+	// streams holds the events of each answer, in sequence order
+	streams map[string][]*model.Event
+	answers map[string]*snapshot
+	lastID  int64
+
+	// persist, if not nil, is called with the events of each batch before they become visible.
+	// If it fails, the batch is discarded.
+	persist func(events []*model.Event) error
+	// rewrite, if not nil, is called with the events retained by a compaction before they replace the log,
+	// and returns the space it has reclaimed. If it fails, the compaction is discarded.
+	rewrite func(events []*model.Event) (int64, error)
+	broker  *broker
+}
+
+// OpenMemory returns an empty storage which lives in memory, and is lost when the process exits.
+func OpenMemory() EventStore {
+	return newMemStore()
+}
+
+func newMemStore() *memStore {
+	s := &memStore{
+		streams: make(map[string][]*model.Event),
+		answers: make(map[string]*snapshot),
+		broker:  newBroker(),
+	}
+	s.background = background{s}
+	return s
+}
+
+// append records events, which must follow the last recorded one in sequence order. The caller must hold mu.
+func (s *memStore) append(events ...*model.Event) {
+	for _, e := range events {
+		s.events = append(s.events, e)
+		s.streams[e.Data.Key] = append(s.streams[e.Data.Key], e)
+		s.answers[e.Data.Key] = snapshotOf(e)
+		s.lastID = e.ID
+	}
+}
+
+func snapshotOf(e *model.Event) *snapshot {
+	answ := *e.Data
+	return &snapshot{answer: &answ, deleted: removesAnswer(e.Event), eventID: e.ID}
+}
+
+func copyEvent(e *model.Event) *model.Event {
+	c := *e
+	answ := *e.Data
+	c.Data = &answ
+
+	if e.Metadata != nil {
+		c.Metadata = make(map[string]string, len(e.Metadata))
+		for k, v := range e.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return &c
+}
+
+func (s *memStore) ApplyContext(ctx context.Context, ops []Operation, opts ...WriteOption) ([]OperationResult, error) {
+	o := applyWriteOptions(opts)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	timestamp := unixNanoToTime(time.Now().UnixNano())
+
+	// staged holds the state of the answers modified by the batch, which is not visible until all the operations succeed
+	staged := make(map[string]*snapshot)
+	results := make([]OperationResult, len(ops))
+	events := make([]*model.Event, 0, len(ops))
+	for i := range ops {
+		op := &ops[i]
+
+		var snap *snapshot
+		if op.Answer != nil {
+			if snap = staged[op.Answer.Key]; snap == nil {
+				snap = s.answers[op.Answer.Key]
+			}
+		}
+
+		e, err := nextEvent(op, snap, o, func(key string, version int64) (string, error) {
+			return s.restoredValue(key, version, events)
+		})
+		if isOperationError(err) {
+			return abortedResults(len(ops), i, err), ErrBatchAborted
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		e.ID = s.lastID + int64(len(events)) + 1
+		e.Timestamp = timestamp
+		e = copyEvent(e)
+
+		staged[e.Data.Key] = snapshotOf(e)
+		results[i].Version = e.Version
+		events = append(events, e)
+	}
+
+	if s.persist != nil {
+		if err := s.persist(events); err != nil {
+			return nil, err
+		}
+	}
+	s.append(events...)
+
+	published := make([]*model.Event, len(events))
+	for i, e := range events {
+		*ops[i].Answer = *e.Data
+		published[i] = copyEvent(e)
+	}
+
+	s.broker.publish(published...)
+	return results, nil
+}
+
+// appendEvents records events produced by another store, preserving their sequence numbers.
+func (s *memStore) appendEvents(ctx context.Context, events []*model.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	copied := make([]*model.Event, len(events))
+	for i, e := range events {
+		lastID := s.lastID
+		if i > 0 {
+			lastID = events[i-1].ID
+		}
+
+		if err := checkAppended(e, lastID); err != nil {
+			return err
+		}
+		copied[i] = copyEvent(e)
+	}
+
+	if s.persist != nil {
+		if err := s.persist(copied); err != nil {
+			return err
+		}
+	}
+	s.append(copied...)
+
+	s.broker.publish(events...)
+	return nil
+}
+
+// restoredValue returns the value held by the answer with the given key at the given version,
+// looking also at the events staged by the current batch.
+func (s *memStore) restoredValue(key string, version int64, staged []*model.Event) (string, error) {
+	stream := s.streams[key]
+
+	var e *model.Event
+	if i := sort.Search(len(stream), func(i int) bool { return stream[i].Version >= version }); i < len(stream) && stream[i].Version == version {
+		e = stream[i]
+	}
+
+	for _, se := range staged {
+		if se.Data.Key == key && se.Version == version {
+			e = se
+		}
+	}
+
+	if e == nil {
+		return "", ErrVersionNotExist
+	}
+
+	if removesAnswer(e.Event) {
+		return "", ErrVersionNotRestorable
+	}
+	return e.Data.Value, nil
+}
+
+func (s *memStore) RestoreContext(ctx context.Context, key string, toVersion int64, opts ...WriteOption) (*model.Answer, error) {
+	return restoreAnswer(ctx, s, key, toVersion, opts)
+}
+
+func (s *memStore) CreateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error {
+	return writeAnswer(ctx, s, model.CreateEvent, a, opts)
+}
+
+func (s *memStore) UpdateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error {
+	return writeAnswer(ctx, s, model.UpdateEvent, a, opts)
+}
+
+func (s *memStore) DeleteContext(ctx context.Context, key string, opts ...WriteOption) error {
+	return writeAnswer(ctx, s, model.DeleteEvent, &model.Answer{Key: key}, opts)
+}
+
+func (s *memStore) GetAnswerContext(ctx context.Context, key string) (*model.Answer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := s.answers[key]
+	if snap == nil || snap.deleted {
+		return nil, ErrAnswerNotExist
+	}
+
+	answ := *snap.answer
+	return &answ, nil
+}
+
+func (s *memStore) GetAnswerAtContext(ctx context.Context, key string, asOf AsOf) (*model.Answer, error) {
+	if asOf.Sequence <= 0 && asOf.Time.IsZero() {
+		return s.GetAnswerContext(ctx, key)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var e *model.Event
+	stream := s.streams[key]
+	for i := len(stream) - 1; i >= 0; i-- {
+		if (asOf.Sequence > 0 && stream[i].ID <= asOf.Sequence) ||
+			(asOf.Sequence <= 0 && !stream[i].Timestamp.After(asOf.Time)) {
+			e = stream[i]
+			break
+		}
+	}
+
+	if e == nil || removesAnswer(e.Event) {
+		return nil, ErrAnswerNotExist
+	}
+
+	answ := *e.Data
+	return &answ, nil
+}
+
+func (s *memStore) ListAnswersContext(ctx context.Context, opts ListOptions) ([]*model.Answer, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if opts.SortBy != "" && opts.SortBy != SortByKey && opts.SortBy != SortByUpdate {
+		return nil, "", fmt.Errorf("unknown sort field %q", opts.SortBy)
+	}
+	byUpdate := opts.SortBy == SortByUpdate
+
+	var cursor *listCursor
+	if opts.Cursor != "" {
+		var err error
+		if cursor, err = decodeListCursor(opts.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	query := strings.ToLower(opts.Query)
+
+	s.mu.RLock()
+	snaps := make([]*snapshot, 0)
+	for key, snap := range s.answers {
+		if snap.deleted || !strings.HasPrefix(key, opts.Prefix) {
+			continue
+		}
+
+		if query != "" && !strings.Contains(strings.ToLower(snap.answer.Value), query) {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	s.mu.RUnlock()
+
+	// less reports whether a precedes b in the requested order
+	less := func(a, b *snapshot) bool {
+		if byUpdate {
+			return a.eventID < b.eventID
+		}
+		return a.answer.Key < b.answer.Key
+	}
+	if opts.Descending {
+		asc := less
+		less = func(a, b *snapshot) bool { return asc(b, a) }
+	}
+
+	sort.Slice(snaps, func(i, j int) bool { return less(snaps[i], snaps[j]) })
+
+	if cursor != nil {
+		last := &snapshot{answer: &model.Answer{Key: cursor.Key}, eventID: cursor.EventID}
+		snaps = snaps[sort.Search(len(snaps), func(i int) bool { return less(last, snaps[i]) }):]
+	}
+
+	var next string
+	if opts.Limit > 0 && len(snaps) > opts.Limit {
+		snaps = snaps[:opts.Limit]
+
+		last := snaps[len(snaps)-1]
+		cursor := &listCursor{Key: last.answer.Key}
+		if byUpdate {
+			cursor = &listCursor{EventID: last.eventID}
+		}
+		next = cursor.encode()
+	}
+
+	answers := make([]*model.Answer, len(snaps))
+	for i, snap := range snaps {
+		answ := *snap.answer
+		answers[i] = &answ
+	}
+	return answers, next, nil
+}
+
+func (s *memStore) GetHistoryContext(ctx context.Context, key string) (EventIterator, error) {
+	return s.QueryHistoryContext(ctx, key, HistoryOptions{})
+}
+
+func (s *memStore) QueryHistoryContext(ctx context.Context, key string, opts HistoryOptions) (EventIterator, error) {
+	s.mu.RLock()
+	stream := s.streams[key]
+	s.mu.RUnlock()
+
+	match := func(e *model.Event) bool {
+		if opts.After > 0 && ((opts.Descending && e.ID >= opts.After) || (!opts.Descending && e.ID <= opts.After)) {
+			return false
+		}
+
+		if len(opts.Types) > 0 {
+			found := false
+			for _, t := range opts.Types {
+				found = found || e.Event == t
+			}
+
+			if !found {
+				return false
+			}
+		}
+
+		if !opts.From.IsZero() && e.Timestamp.Before(opts.From) {
+			return false
+		}
+		return opts.To.IsZero() || e.Timestamp.Before(opts.To)
+	}
+
+	events := make([]*model.Event, 0)
+	for i := range stream {
+		e := stream[i]
+		if opts.Descending {
+			e = stream[len(stream)-1-i]
+		}
+
+		if opts.Limit > 0 && len(events) == opts.Limit {
+			break
+		}
+
+		if match(e) {
+			events = append(events, copyEvent(e))
+		}
+	}
+	return &sliceIterator{ctx: ctx, events: events}, nil
+}
+
+func (s *memStore) ReadAllContext(ctx context.Context, fromSequence int64, limit int) (EventIterator, error) {
+	s.mu.RLock()
+	all := s.events
+	s.mu.RUnlock()
+
+	i := sort.Search(len(all), func(i int) bool { return all[i].ID >= fromSequence })
+
+	events := make([]*model.Event, 0)
+	for ; i < len(all) && (limit <= 0 || len(events) < limit); i++ {
+		events = append(events, copyEvent(all[i]))
+	}
+	return &sliceIterator{ctx: ctx, events: events}, nil
+}
+
+func (s *memStore) Subscribe() Subscription {
+	return s.broker.subscribe()
+}
+
+// BackupContext writes the events recorded so far. Since recorded events are never modified,
+// the lock is only held while taking a snapshot of the log.
+func (s *memStore) BackupContext(ctx context.Context, w io.Writer) error {
+	s.mu.RLock()
+	events := s.events[:len(s.events):len(s.events)]
+	s.mu.RUnlock()
+
+	return writeLog(w, &sliceIterator{ctx: ctx, events: events})
+}
+
+func (s *memStore) CompactContext(ctx context.Context, policy RetentionPolicy) (CompactionReport, error) {
+	var report CompactionReport
+	if err := policy.Validate(); err != nil {
+		return report, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	now := time.Now()
+	purgeCutoff := now.Add(-policy.PurgeDeletedAfter)
+
+	streams := make(map[string][]*model.Event, len(s.streams))
+	for key, stream := range s.streams {
+		last := stream[len(stream)-1]
+
+		// the last event of the log is kept, so that its sequence number is not reused
+		if policy.PurgeDeletedAfter > 0 && last.Event == model.DeleteEvent && last.Timestamp.Before(purgeCutoff) && last.ID != s.lastID &&
+			!hasErasure(stream) {
+			report.RemovedEvents += int64(len(stream))
+			report.PurgedAnswers++
+			continue
+		}
+
+		// removed events are the oldest ones
+		removed := 0
+		for removed < len(stream) && !policy.retains(len(stream)-removed, stream[removed].Timestamp, now) {
+			removed++
+		}
+
+		retained := stream[removed:]
+
+		if policy.Snapshot && removed > 0 && stream[removed-1].Event != model.EraseEvent {
+			// the last removed event is kept, as a snapshot of the state reached by the removed events
+			e := stream[removed-1]
+			if e.Event != model.DeleteEvent && e.Event != model.SnapshotEvent {
+				// recorded events are shared with readers, and must not be modified
+				e = copyEvent(e)
+				e.Event = model.SnapshotEvent
+				report.Snapshots++
+			}
+
+			retained = append([]*model.Event{e}, retained...)
+			removed--
+		}
+
+		// erasure events are never removed. Since an erasure removes all the previous events of the answer,
+		// they precede the other events of the stream
+		erasures := 0
+		for erasures < removed && stream[erasures].Event == model.EraseEvent {
+			erasures++
+		}
+		retained = append(stream[:erasures:erasures], retained...)
+
+		report.RemovedEvents += int64(removed - erasures)
+		streams[key] = retained
+	}
+
+	if report.RemovedEvents == 0 && report.Snapshots == 0 {
+		return report, nil
+	}
+
+	// replace the events of the log with the retained ones, preserving their order
+	kept := make(map[int64]*model.Event, len(s.events)-int(report.RemovedEvents))
+	for _, stream := range streams {
+		for _, e := range stream {
+			kept[e.ID] = e
+		}
+	}
+
+	events := make([]*model.Event, 0, len(kept))
+	for _, e := range s.events {
+		if ke, ok := kept[e.ID]; ok {
+			events = append(events, ke)
+		}
+	}
+
+	if s.rewrite != nil {
+		reclaimed, err := s.rewrite(events)
+		if err != nil {
+			return CompactionReport{}, err
+		}
+		report.ReclaimedBytes = reclaimed
+	}
+
+	s.events = events
+	s.streams = streams
+	for key := range s.answers {
+		if _, ok := streams[key]; !ok {
+			delete(s.answers, key)
+		}
+	}
+	return report, nil
+}
+
+func hasErasure(stream []*model.Event) bool {
+	// erasure events precede the other events of the stream
+	return stream[0].Event == model.EraseEvent
+}
+
+// EraseContext builds a new log, without the erased events, so that they are no longer referenced by the store.
+func (s *memStore) EraseContext(ctx context.Context, key string, opts ...WriteOption) (*model.Event, error) {
+	o := applyWriteOptions(opts)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stream := s.streams[key]
+
+	erasures := 0
+	for erasures < len(stream) && stream[erasures].Event == model.EraseEvent {
+		erasures++
+	}
+
+	e, err := erasureEvent(key, s.answers[key], o, int64(len(stream)-erasures))
+	if err != nil {
+		return nil, err
+	}
+	e.ID = s.lastID + 1
+	e.Timestamp = unixNanoToTime(time.Now().UnixNano())
+
+	events := make([]*model.Event, 0, len(s.events)-len(stream)+erasures+1)
+	for _, le := range s.events {
+		if le.Data.Key != key || le.Event == model.EraseEvent {
+			events = append(events, le)
+		}
+	}
+	events = append(events, e)
+
+	if s.rewrite != nil {
+		if _, err := s.rewrite(events); err != nil {
+			return nil, err
+		}
+	}
+
+	s.events = events
+	s.streams[key] = append(stream[:erasures:erasures], e)
+	s.answers[key] = snapshotOf(e)
+	s.lastID = e.ID
+
+	s.broker.publish(copyEvent(e))
+	return copyEvent(e), nil
+}
+
+func (s *memStore) RebuildContext(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.answers = make(map[string]*snapshot, len(s.streams))
+	for key, stream := range s.streams {
+		s.answers[key] = snapshotOf(stream[len(stream)-1])
+	}
+	return nil
+}
+
+func (s *memStore) Close() error {
+	s.broker.close()
+	return nil
+}
+
+// sliceIterator iterates over events which have already been loaded in memory.
+type sliceIterator struct {
+	ctx    context.Context
+	events []*model.Event
+	pos    int
+	err    error
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.err = it.ctx.Err(); it.err != nil || it.pos >= len(it.events) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
+
+func (it *sliceIterator) Value() (*model.Event, error) {
+	return it.events[it.pos-1], nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
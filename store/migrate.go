@@ -0,0 +1,315 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// Migration is an upgrade of the schema of a SQL storage.
+type Migration struct {
+	Version     int
+	Description string
+	// SQL holds the statements executed by the migration.
+	SQL string
+}
+
+// AppliedMigration is a migration which has been applied to a storage.
+type AppliedMigration struct {
+	Version     int
+	Description string
+	// AppliedAt is zero for migrations included in the schema of databases created before migrations were introduced.
+	AppliedAt time.Time
+}
+
+// SchemaStatus describes the migrations applied to a SQL storage and the ones which are still pending.
+type SchemaStatus struct {
+	// Version is the current schema version, that is the version of the last applied migration.
+	Version int
+	Applied []AppliedMigration
+	Pending []Migration
+}
+
+// loadMigrations returns the migrations found in the given directory of migrationsFS, sorted by version.
+// Migration files are named after their version and description, as in "0001_create_event.sql".
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := migrationsFS.ReadDir(path.Join("migrations", dir))
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+
+		prefix, description, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !found || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+
+		data, err := migrationsFS.ReadFile(path.Join("migrations", dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version:     version,
+			Description: strings.ReplaceAll(description, "_", " "),
+			SQL:         string(data),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("missing migration %d in %s", i+1, dir)
+		}
+	}
+	return migrations, nil
+}
+
+const createSchemaVersionStmt = `CREATE TABLE IF NOT EXISTS schema_version (
+	version integer NOT NULL PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at BIGINT NOT NULL
+)`
+
+// migrate applies the pending migrations, if apply is true, and returns the status of the schema before they are applied.
+// Migrations run in a single transaction, which holds an exclusive lock on the database, so that concurrent processes
+// never apply the same migration twice.
+func (s *storeImpl) migrate(ctx context.Context, apply bool) (*SchemaStatus, error) {
+	migrations, err := loadMigrations(s.dialect.migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, stmt := range s.dialect.beginMigration {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	status, err := s.applyMigrations(ctx, conn, migrations, apply)
+	if err != nil {
+		conn.ExecContext(ctx, `ROLLBACK`)
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (s *storeImpl) applyMigrations(ctx context.Context, conn *sql.Conn, migrations []Migration, apply bool) (*SchemaStatus, error) {
+	exists, err := s.dialect.tableExists(ctx, conn, "schema_version")
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if !apply {
+			return s.unversionedStatus(ctx, conn, migrations)
+		}
+
+		if err := s.adopt(ctx, conn, migrations); err != nil {
+			return nil, err
+		}
+	}
+
+	status, err := s.status(ctx, conn, migrations)
+	if err != nil || !apply {
+		return status, err
+	}
+
+	for _, migration := range status.Pending {
+		if _, err := conn.ExecContext(ctx, migration.SQL); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+
+		if err := s.record(ctx, conn, migration, time.Now().UnixNano()); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// adopt creates the schema_version table. Databases created before migrations were introduced
+// are marked as having applied the migrations their schema already includes.
+func (s *storeImpl) adopt(ctx context.Context, conn *sql.Conn, migrations []Migration) error {
+	version := 0
+	if s.dialect.detectVersion != nil {
+		var err error
+		if version, err = s.dialect.detectVersion(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, createSchemaVersionStmt); err != nil {
+		return err
+	}
+
+	// the time adopted migrations were applied at is unknown
+	for _, migration := range migrations[:version] {
+		if err := s.record(ctx, conn, migration, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unversionedStatus reports the status of a database which has no schema_version table yet, without modifying it.
+func (s *storeImpl) unversionedStatus(ctx context.Context, conn *sql.Conn, migrations []Migration) (*SchemaStatus, error) {
+	status := &SchemaStatus{Pending: migrations}
+	if s.dialect.detectVersion == nil {
+		return status, nil
+	}
+
+	version, err := s.dialect.detectVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	status.Version = version
+	for _, migration := range migrations[:version] {
+		status.Applied = append(status.Applied, AppliedMigration{Version: migration.Version, Description: migration.Description})
+	}
+	status.Pending = migrations[version:]
+	return status, nil
+}
+
+func (s *storeImpl) status(ctx context.Context, conn *sql.Conn, migrations []Migration) (*SchemaStatus, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, description, applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	status := &SchemaStatus{}
+	for rows.Next() {
+		var applied AppliedMigration
+		var appliedAt int64
+		if err := rows.Scan(&applied.Version, &applied.Description, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied.AppliedAt = unixNanoToTime(appliedAt)
+
+		status.Applied = append(status.Applied, applied)
+		status.Version = applied.Version
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if status.Version > len(migrations) {
+		return nil, fmt.Errorf("the schema version of the database (%d) is newer than the latest supported one (%d)", status.Version, len(migrations))
+	}
+
+	status.Pending = migrations[status.Version:]
+	return status, nil
+}
+
+func (s *storeImpl) record(ctx context.Context, conn *sql.Conn, migration Migration, appliedAt int64) error {
+	stmt := s.rebind(`INSERT INTO schema_version(version, description, applied_at) VALUES (?, ?, ?)`)
+
+	_, err := conn.ExecContext(ctx, stmt, migration.Version, migration.Description, appliedAt)
+	return err
+}
+
+// sqlOpener connects to the SQL database identified by a storage URL, without upgrading its schema.
+type sqlOpener func(u *url.URL) (*storeImpl, error)
+
+var sqlOpeners = make(map[string]sqlOpener)
+
+// registerSQL registers a SQL backend, whose storages are upgraded to the latest schema version when opened.
+func registerSQL(scheme string, open sqlOpener) {
+	sqlOpeners[scheme] = open
+
+	Register(scheme, func(u *url.URL) (EventStore, error) {
+		s, err := open(u)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.upgrade(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// upgrade applies the pending migrations to a newly opened storage, which is closed on failure.
+func (s *storeImpl) upgrade() error {
+	ctx := context.Background()
+	if _, err := s.migrate(ctx, true); err != nil {
+		s.Close()
+		return err
+	}
+
+	if s.dialect.prepare != nil {
+		if err := s.dialect.prepare(ctx, s); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func openUnmigrated(rawURL string) (*storeImpl, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	open, ok := sqlOpeners[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("the %s backend has no schema to migrate", u.Scheme)
+	}
+	return open(u)
+}
+
+// GetSchemaStatus returns the schema status of the SQL storage identified by rawURL, without upgrading it.
+func GetSchemaStatus(rawURL string) (*SchemaStatus, error) {
+	s, err := openUnmigrated(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.migrate(context.Background(), false)
+}
+
+// Migrate upgrades the SQL storage identified by rawURL to the latest schema version, and returns the applied migrations.
+// Storages are upgraded automatically when opened: Migrate allows to upgrade them in advance.
+func Migrate(rawURL string) ([]Migration, error) {
+	s, err := openUnmigrated(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	status, err := s.migrate(context.Background(), true)
+	if err != nil {
+		return nil, err
+	}
+	return status.Pending, nil
+}
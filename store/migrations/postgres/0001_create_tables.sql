@@ -0,0 +1,25 @@
+-- keys use the "C" collation, so that they are sorted byte-wise as by the other backends,
+-- and range conditions on prefixes can use the primary key index.
+CREATE TABLE IF NOT EXISTS event (
+	id BIGSERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	key TEXT COLLATE "C" NOT NULL,
+	value TEXT NULL,
+	version BIGINT NOT NULL DEFAULT 0,
+	timestamp BIGINT NOT NULL DEFAULT 0,
+	actor TEXT NULL,
+	metadata TEXT NULL
+);
+
+CREATE INDEX IF NOT EXISTS key_index ON event(key, id);
+
+CREATE TABLE IF NOT EXISTS answer (
+	key TEXT COLLATE "C" NOT NULL PRIMARY KEY,
+	value TEXT NULL,
+	version BIGINT NOT NULL,
+	deleted BOOLEAN NOT NULL DEFAULT FALSE,
+	event_id BIGINT NOT NULL,
+	timestamp BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS answer_event_index ON answer(event_id);
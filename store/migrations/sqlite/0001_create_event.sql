@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS event (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"type" TEXT NOT NULL,
+	"key" TEXT,
+	"value" TEXT NULL
+);
+
+-- since the table can grow a lot, we create an index on the key field to speed-up search queries
+CREATE INDEX IF NOT EXISTS key_index ON event(key);
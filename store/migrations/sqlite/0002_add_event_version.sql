@@ -0,0 +1,6 @@
+ALTER TABLE event ADD COLUMN "version" integer NOT NULL DEFAULT 0;
+
+-- number the existing events of each stream starting from 1, in a single pass over the table
+UPDATE event SET version = v.n
+FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY key ORDER BY id) AS n FROM event) AS v
+WHERE v.id = event.id;
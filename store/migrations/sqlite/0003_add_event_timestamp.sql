@@ -0,0 +1,2 @@
+-- existing events are left with a zero timestamp
+ALTER TABLE event ADD COLUMN "timestamp" integer NOT NULL DEFAULT 0;
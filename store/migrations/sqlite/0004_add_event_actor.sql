@@ -0,0 +1 @@
+ALTER TABLE event ADD COLUMN "actor" TEXT NULL;
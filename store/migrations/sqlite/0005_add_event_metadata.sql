@@ -0,0 +1 @@
+ALTER TABLE event ADD COLUMN "metadata" TEXT NULL;
@@ -0,0 +1,17 @@
+-- the answer table is a projection of the event table, holding the latest state of each answer
+-- (including deleted ones, to keep track of their version), so that reads do not need to scan the event log.
+CREATE TABLE answer (
+	"key" TEXT NOT NULL PRIMARY KEY,
+	"value" TEXT NULL,
+	"version" integer NOT NULL,
+	"deleted" integer NOT NULL DEFAULT 0,
+	"event_id" integer NOT NULL,
+	"timestamp" integer NOT NULL DEFAULT 0
+);
+
+-- allows to list answers by modification time
+CREATE INDEX answer_event_index ON answer(event_id);
+
+INSERT INTO answer(key, value, version, deleted, event_id, timestamp)
+	SELECT key, value, version, type = 'delete', id, timestamp FROM event
+	WHERE id IN (SELECT MAX(id) FROM event GROUP BY key);
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+
+	"github.com/ostafen/demo/model"
+)
+
+// snapshot is the latest state of an answer.
+type snapshot struct {
+	answer  *model.Answer
+	deleted bool
+	// eventID is the sequence number of the last event of the answer.
+	eventID int64
+}
+
+// nextEvent checks that op is allowed by snap, the current state of its answer (nil if no event has ever been
+// recorded for it), and returns the event produced by op. The value reinstated by a restore is resolved through restoredValue.
+// Sequence number and timestamp of the event are assigned by the store when the event is recorded.
+func nextEvent(op *Operation, snap *snapshot, o *writeOptions, restoredValue func(key string, version int64) (string, error)) (*model.Event, error) {
+	if op.Answer == nil {
+		return nil, ErrInvalidOperation
+	}
+
+	exists := snap != nil && !snap.deleted
+	switch op.Type {
+	case model.CreateEvent:
+		if exists {
+			return nil, ErrAnswerExist
+		}
+	case model.UpdateEvent, model.DeleteEvent:
+		if !exists {
+			return nil, ErrAnswerNotExist
+		}
+	case model.RestoreEvent:
+		// deleted answers can be restored as well
+		if snap == nil {
+			return nil, ErrAnswerNotExist
+		}
+	default:
+		return nil, ErrInvalidOperation
+	}
+
+	var version int64
+	if snap != nil {
+		version = snap.answer.Version
+	}
+
+	if op.ExpectedVersion != AnyVersion && op.ExpectedVersion != version {
+		return nil, ErrVersionMismatch
+	}
+
+	value := op.Answer.Value
+	switch op.Type {
+	case model.DeleteEvent:
+		value = ""
+	case model.RestoreEvent:
+		var err error
+		if value, err = restoredValue(op.Answer.Key, op.RestoreVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	return &model.Event{
+		Event:    op.Type,
+		Version:  version + 1,
+		Actor:    o.actor,
+		Metadata: o.metadata,
+		Data:     &model.Answer{Key: op.Answer.Key, Value: value, Version: version + 1},
+	}, nil
+}
+
+// ErasedEventsMetadata is the metadata key of an erasure event holding the number of erased events.
+const ErasedEventsMetadata = "erased_events"
+
+// removesAnswer reports whether events of type t leave their answer deleted.
+func removesAnswer(t model.EventType) bool {
+	return t == model.DeleteEvent || t == model.EraseEvent
+}
+
+// erasureEvent checks that the answer with the given key, whose current state is snap, can be erased,
+// and returns the event recording the erasure of the given number of events.
+func erasureEvent(key string, snap *snapshot, o *writeOptions, erased int64) (*model.Event, error) {
+	if snap == nil {
+		return nil, ErrAnswerNotExist
+	}
+
+	version := snap.answer.Version
+	if o.expectedVersion != AnyVersion && o.expectedVersion != version {
+		return nil, ErrVersionMismatch
+	}
+
+	metadata := make(map[string]string, len(o.metadata)+1)
+	for k, v := range o.metadata {
+		metadata[k] = v
+	}
+	metadata[ErasedEventsMetadata] = strconv.FormatInt(erased, 10)
+
+	return &model.Event{
+		Event:    model.EraseEvent,
+		Version:  version + 1,
+		Actor:    o.actor,
+		Metadata: metadata,
+		Data:     &model.Answer{Key: key, Version: version + 1},
+	}, nil
+}
+
+// abortedResults reports the failure of the i-th operation of a batch of n operations.
+func abortedResults(n, i int, err error) []OperationResult {
+	results := make([]OperationResult, n)
+	for j := range results {
+		results[j] = OperationResult{Err: ErrBatchAborted}
+	}
+	results[i].Err = err
+	return results
+}
+
+// writeAnswer applies a single operation of type t on answer a. On success, a is set to the state produced by the operation.
+func writeAnswer(ctx context.Context, s EventStore, t model.EventType, a *model.Answer, opts []WriteOption) error {
+	o := applyWriteOptions(opts)
+
+	results, err := s.ApplyContext(ctx, []Operation{{Type: t, Answer: a, ExpectedVersion: o.expectedVersion}}, opts...)
+	if err == ErrBatchAborted {
+		return results[0].Err
+	}
+	return err
+}
+
+func restoreAnswer(ctx context.Context, s EventStore, key string, toVersion int64, opts []WriteOption) (*model.Answer, error) {
+	o := applyWriteOptions(opts)
+
+	answ := &model.Answer{Key: key}
+	op := Operation{Type: model.RestoreEvent, Answer: answ, ExpectedVersion: o.expectedVersion, RestoreVersion: toVersion}
+
+	results, err := s.ApplyContext(ctx, []Operation{op}, opts...)
+	if err == ErrBatchAborted {
+		return nil, results[0].Err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return answ, nil
+}
+
+// listCursor points to the last answer of a page, according to the sort field.
+type listCursor struct {
+	Key     string `json:"k,omitempty"`
+	EventID int64  `json:"e,omitempty"`
+}
+
+func (c *listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(cursor string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	c := &listCursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// prefixUpperBound returns the smallest string which is greater than all the strings starting with prefix,
+// or an empty string if no such string exists.
+func prefixUpperBound(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
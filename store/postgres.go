@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strconv"
+
+	_ "github.com/lib/pq" // Import PostgreSQL driver
+)
+
+var postgresDialect = &dialect{
+	placeholder: func(n int) string {
+		return "$" + strconv.Itoa(n)
+	},
+	// sequence numbers are allocated when events are inserted, but become visible on commit:
+	// serializing writers guarantees that readers never observe gaps which are filled later.
+	lockStmt:         `LOCK TABLE event IN EXCLUSIVE MODE`,
+	syncSequenceStmt: `SELECT setval(pg_get_serial_sequence('event', 'id'), MAX(id)) FROM event`,
+
+	migrations: "postgres",
+	// the advisory lock is released when the transaction ends
+	beginMigration: []string{`BEGIN`, `SELECT pg_advisory_xact_lock(hashtext('schema_version'))`},
+	tableExists:    postgresTableExists,
+
+	// a plain vacuum makes the space of deleted rows reusable, and only returns the free pages at the end of the tables
+	// to the file system, without blocking concurrent writes as VACUUM FULL would
+	vacuum:    []string{`VACUUM event`, `VACUUM answer`},
+	sizeQuery: `SELECT pg_total_relation_size('event') + pg_total_relation_size('answer')`,
+	purge:     purgePostgres,
+}
+
+func init() {
+	open := func(u *url.URL) (*storeImpl, error) {
+		return openPostgres(u.String())
+	}
+	registerSQL("postgres", open)
+	registerSQL("postgresql", open)
+}
+
+// OpenPostgres opens a storage on the PostgreSQL database identified by dsn, upgrading its schema if needed.
+// The dsn is either a connection URL or a list of key=value settings.
+func OpenPostgres(dsn string) (EventStore, error) {
+	store, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.upgrade(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func openPostgres(dsn string) (*storeImpl, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &storeImpl{
+		db:      db,
+		readDB:  db,
+		dialect: postgresDialect,
+		broker:  newBroker(),
+	}
+	store.background = background{store}
+	return store, nil
+}
+
+// purgePostgres vacuums the tables after an erasure, so that the erased rows are removed from their pages rather than
+// waiting for autovacuum. The rows still visible to open transactions are kept, and the removed ones are only
+// overwritten as the space is reused: PostgreSQL does not guarantee that erased values are unrecoverable.
+func purgePostgres(ctx context.Context, s *storeImpl) error {
+	for _, stmt := range s.dialect.vacuum {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func postgresTableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var exists bool
+	err := conn.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+	return exists, err
+}
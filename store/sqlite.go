@@ -0,0 +1,400 @@
+//go:build cgo
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = &dialect{
+	migrations: "sqlite",
+	// an immediate transaction acquires the write lock of the database right away
+	beginMigration: []string{`BEGIN IMMEDIATE`},
+	tableExists:    sqliteTableExists,
+	detectVersion:  detectSQLiteVersion,
+	backup:         backupSQLite,
+	// in WAL mode, the database file only shrinks when the log is checkpointed
+	vacuum:    []string{`VACUUM`, `PRAGMA wal_checkpoint(TRUNCATE)`},
+	sizeQuery: `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`,
+	purge:     purgeSQLite,
+}
+
+// sqlitePurgeStmts are executed by purgeSQLite before checkpointing the write-ahead log.
+var sqlitePurgeStmts []string
+
+// errCheckpointBusy is returned when the write-ahead log cannot be checkpointed, because readers are still using it.
+var errCheckpointBusy = errors.New("the write-ahead log is in use")
+
+// purgeSQLite checkpoints and truncates the write-ahead log, which holds the erased rows until the pages overwriting them
+// are copied to the database file. The checkpoint waits for the readers of the log up to the busy timeout, and is
+// reported as busy if they are still reading.
+func purgeSQLite(ctx context.Context, s *storeImpl) error {
+	for _, stmt := range sqlitePurgeStmts {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	var busy, log, checkpointed int
+	if err := s.db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &log, &checkpointed); err != nil {
+		return err
+	}
+
+	if busy != 0 {
+		return errCheckpointBusy
+	}
+	return nil
+}
+
+// answerIndexTriggers keep the FTS5 table indexing the values of the answers, in builds with the sqlite_fts5 tag,
+// in sync with the answer table.
+var answerIndexTriggers = []string{"answer_fts_insert", "answer_fts_delete", "answer_fts_update"}
+
+func init() {
+	registerSQL("sqlite", func(u *url.URL) (*storeImpl, error) {
+		opts, err := parseOptions(u.Query())
+		if err != nil {
+			return nil, err
+		}
+		return openSQLite(urlPath(u), opts)
+	})
+
+	openSQLiteBackup = func(dir string) (EventStore, error) {
+		if err := checkSQLiteIntegrity(path.Join(dir, dbFilename)); err != nil {
+			return nil, err
+		}
+		return Open(dir)
+	}
+	lockSQLite = lockSQLiteDB
+}
+
+// lockSQLiteDB takes an exclusive lock on the database file located at dbPath, which is held by a connection
+// until the returned function is called. In WAL mode, the open connections of other processes hold a shared lock
+// on the database file, so that the lock cannot be taken while they are open.
+func lockSQLiteDB(dbPath string) (func() error, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return func() error { return nil }, nil
+	}
+
+	db, err := sql.Open("sqlite3", sqliteURI(dbPath, "_locking_mode=EXCLUSIVE", "_busy_timeout=0"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`BEGIN EXCLUSIVE`); err != nil {
+		db.Close()
+		if sqliteErr, ok := err.(sqlite3.Error); ok && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+			return nil, ErrStorageInUse
+		}
+		return nil, err
+	}
+	return db.Close, nil
+}
+
+func createDBFileIfNotExists(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0666) // Create SQLite file
+	if err != nil && err != os.ErrExist {
+		return err
+	}
+	return file.Close()
+}
+
+// Open opens the SQLite storage located in the given directory, upgrading its schema if needed.
+func Open(dir string) (EventStore, error) {
+	return OpenWithOptions(dir, DefaultOptions())
+}
+
+// OpenWithOptions is like Open, but tunes the database with the given options.
+func OpenWithOptions(dir string, opts Options) (EventStore, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	store, err := openSQLite(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.upgrade(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func openSQLite(dir string, opts Options) (*storeImpl, error) {
+	// the shared lock prevents the database from being replaced by a restore while the storage is open
+	lock, err := lockFile(path.Join(dir, lockFilename), false)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openSQLiteDB(path.Join(dir, dbFilename), opts)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	store.lock = lock
+	return store, nil
+}
+
+func openSQLiteDB(dbPath string, opts Options) (*storeImpl, error) {
+	if err := createDBFileIfNotExists(dbPath); err != nil {
+		return nil, err
+	}
+
+	if !opts.SeparatePools {
+		db, err := sql.Open("sqlite3", sqliteDSN(dbPath, opts))
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+
+		if err := pingSQLite(db, opts.BusyTimeout); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return newSQLiteStore(dbPath, db, db, opts), nil
+	}
+
+	// a single connection writes, and begins each transaction by taking the write lock of the database: a deferred
+	// transaction would take it at the first write instead, and fail without waiting for the busy timeout
+	// if another connection, possibly of another process, has been writing in the meantime
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath, opts, "_txlock=immediate"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	// switch the journal mode before read-only connections are opened
+	if err := pingSQLite(db, opts.BusyTimeout); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	readDB, err := sql.Open("sqlite3", sqliteDSN(dbPath, opts, "_query_only=true"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	readDB.SetMaxOpenConns(opts.MaxOpenConns)
+
+	return newSQLiteStore(dbPath, db, readDB, opts), nil
+}
+
+// pingSQLite opens a connection to db. Concurrent switches of the journal mode of a new database fail right away,
+// without waiting for the busy timeout, so the connection is retried until the timeout expires.
+func pingSQLite(db *sql.DB, busyTimeout time.Duration) error {
+	deadline := time.Now().Add(busyTimeout)
+	for {
+		err := db.Ping()
+		if sqliteErr, ok := err.(sqlite3.Error); !ok || sqliteErr.Code != sqlite3.ErrBusy || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newSQLiteStore(dbPath string, db, readDB *sql.DB, opts Options) *storeImpl {
+	store := &storeImpl{
+		path:        dbPath,
+		db:          db,
+		readDB:      readDB,
+		dialect:     sqliteDialect,
+		broker:      newBroker(),
+		groupCommit: opts.GroupCommit,
+	}
+	store.background = background{store}
+	return store
+}
+
+// sqliteDSN returns the data source name of the database located at dbPath, which applies opts to each connection.
+func sqliteDSN(dbPath string, opts Options, params ...string) string {
+	params = append(params,
+		"_journal_mode="+strings.ToUpper(opts.JournalMode),
+		"_synchronous="+strings.ToUpper(opts.Synchronous),
+		fmt.Sprintf("_busy_timeout=%d", opts.BusyTimeout.Milliseconds()),
+		// deleted rows are overwritten, so that erased values cannot be recovered from the database file or its backups
+		"_secure_delete=on",
+	)
+
+	if opts.CacheSize > 0 {
+		// negative sizes are in KiB rather than in pages
+		params = append(params, fmt.Sprintf("_cache_size=-%d", opts.CacheSize))
+	}
+	return sqliteURI(dbPath, params...)
+}
+
+// sqliteURI returns the URI filename of the database located at dbPath, with the given parameters.
+// The path is escaped, since sqlite decodes it, and "?" and "#" would end it.
+func sqliteURI(dbPath string, params ...string) string {
+	segments := strings.Split(dbPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	uri := "file:" + strings.Join(segments, "/")
+	if len(params) > 0 {
+		uri += "?" + strings.Join(params, "&")
+	}
+	return uri
+}
+
+// backupSQLite copies the database with the online backup API of SQLite, which does not block writers in WAL mode.
+// The copy is made to a temporary file, which is then written to w.
+func backupSQLite(ctx context.Context, s *storeImpl, w io.Writer) error {
+	tmp, err := os.CreateTemp(path.Dir(s.path), ".backup-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := copySQLite(ctx, s.readDB, tmp.Name()); err != nil {
+		return err
+	}
+
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// copySQLite copies the database src to the file dstPath.
+func copySQLite(ctx context.Context, src *sql.DB, dstPath string) error {
+	dst, err := sql.Open("sqlite3", sqliteURI(dstPath))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			backup, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			// copy all the pages in a single step, so that the copy is not restarted by concurrent writes
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// checkSQLiteIntegrity checks the integrity of the database file located at dbPath.
+func checkSQLiteIntegrity(dbPath string) error {
+	db, err := sql.Open("sqlite3", sqliteURI(dbPath, "mode=ro"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the database is corrupted: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func sqliteTableExists(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var count int
+	err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = (?)`, table).Scan(&count)
+	return count > 0, err
+}
+
+func sqliteColumnExists(ctx context.Context, conn *sql.Conn, table, column string) (bool, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// detectSQLiteVersion inspects a database created before migrations were introduced, whose schema was upgraded
+// in place by adding the columns and tables of each migration, in the same order.
+func detectSQLiteVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	exists, err := sqliteTableExists(ctx, conn, "event")
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	version := 1
+	for _, column := range []string{"version", "timestamp", "actor", "metadata"} {
+		exists, err := sqliteColumnExists(ctx, conn, "event", column)
+		if err != nil || !exists {
+			return version, err
+		}
+		version++
+	}
+
+	exists, err = sqliteTableExists(ctx, conn, "answer")
+	if err != nil || !exists {
+		return version, err
+	}
+	return version + 1, nil
+}
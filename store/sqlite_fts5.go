@@ -0,0 +1,81 @@
+//go:build cgo && sqlite_fts5
+
+package store
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+)
+
+// The values of the answers are indexed by an external content FTS5 table, which holds no copy of them.
+// Its trigram tokenizer matches substrings of at least three characters ignoring case, as LIKE does
+// in builds without FTS5, so that both builds return the same answers.
+var createAnswerIndexStmts = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS answer_fts USING fts5(value, content='answer', content_rowid='event_id', tokenize='trigram')`,
+	`CREATE TRIGGER IF NOT EXISTS answer_fts_insert AFTER INSERT ON answer BEGIN
+		INSERT INTO answer_fts(rowid, value) VALUES (new.event_id, new.value);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS answer_fts_delete AFTER DELETE ON answer BEGIN
+		INSERT INTO answer_fts(answer_fts, rowid, value) VALUES ('delete', old.event_id, old.value);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS answer_fts_update AFTER UPDATE ON answer BEGIN
+		INSERT INTO answer_fts(answer_fts, rowid, value) VALUES ('delete', old.event_id, old.value);
+		INSERT INTO answer_fts(rowid, value) VALUES (new.event_id, new.value);
+	END`,
+}
+
+func init() {
+	sqliteDialect.prepare = createAnswerIndex
+	sqliteDialect.searchCondition = matchAnswerIndex
+
+	// the segments of the index keep the trigrams of erased values until they are merged
+	sqlitePurgeStmts = append(sqlitePurgeStmts, `INSERT INTO answer_fts(answer_fts) VALUES ('optimize')`)
+}
+
+// createAnswerIndex creates the index of the answers, or rebuilds it if its triggers have been dropped
+// by a build without FTS5, which may have modified the answer table in the meantime.
+func createAnswerIndex(ctx context.Context, s *storeImpl) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var triggers int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = 'answer' AND name LIKE 'answer\_fts\_%' ESCAPE '\'`).Scan(&triggers)
+	if err != nil {
+		return err
+	}
+
+	if triggers == len(answerIndexTriggers) {
+		return nil
+	}
+
+	// the index is emptied by builds without FTS5, which leave it unusable
+	if _, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS answer_fts`); err != nil {
+		return err
+	}
+
+	for _, stmt := range createAnswerIndexStmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO answer_fts(answer_fts) VALUES ('rebuild')`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// matchAnswerIndex looks up query in the index as a phrase, that is as a substring of the values.
+func matchAnswerIndex(query string) (string, []any) {
+	// shorter queries have no trigrams to look up
+	if utf8.RuneCountInString(query) < 3 {
+		return "", nil
+	}
+
+	phrase := `"` + strings.ReplaceAll(query, `"`, `""`) + `"`
+	return `event_id IN (SELECT rowid FROM answer_fts WHERE answer_fts MATCH (?))`, []any{phrase}
+}
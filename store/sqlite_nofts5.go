@@ -0,0 +1,51 @@
+//go:build cgo && !sqlite_fts5
+
+package store
+
+import (
+	"context"
+)
+
+func init() {
+	sqliteDialect.prepare = dropAnswerIndexTriggers
+}
+
+// dropAnswerIndexTriggers drops the triggers maintaining the index of the answers, created by a build with the
+// sqlite_fts5 tag, since they fail to write to the index without FTS5. The index is emptied as well, so that it keeps
+// no trace of the values erased in the meantime, and is rebuilt when the storage is opened again by such a build.
+func dropAnswerIndexTriggers(ctx context.Context, s *storeImpl) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, trigger := range answerIndexTriggers {
+		if _, err := tx.ExecContext(ctx, `DROP TRIGGER IF EXISTS `+trigger); err != nil {
+			return err
+		}
+	}
+
+	// the shadow tables of the index are ordinary tables, which can be written without FTS5: the segments of the
+	// index are deleted, while the records describing its structure (whose rowids are up to 10) are kept, so that
+	// a build with FTS5 can still drop the index
+	stmts := map[string]string{
+		"answer_fts_data":    `DELETE FROM answer_fts_data WHERE id > 10`,
+		"answer_fts_idx":     `DELETE FROM answer_fts_idx`,
+		"answer_fts_docsize": `DELETE FROM answer_fts_docsize`,
+	}
+	for table, stmt := range stmts {
+		var count int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = (?)`, table).Scan(&count)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options tunes the SQLite backend.
+type Options struct {
+	// JournalMode is the journal mode of the database: DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF.
+	// In WAL mode, readers do not block the writer, and vice versa.
+	JournalMode string
+	// Synchronous controls how often SQLite waits for data to reach the disk: OFF, NORMAL, FULL or EXTRA.
+	// NORMAL is safe against corruption in WAL mode, but the last transactions may be lost on power failure.
+	Synchronous string
+	// BusyTimeout is how long a connection waits for a lock held by another connection,
+	// possibly of another process, before failing with "database is locked".
+	BusyTimeout time.Duration
+	// CacheSize is the maximum size of the page cache of each connection, in KiB. Zero keeps the SQLite default.
+	CacheSize int
+	// MaxOpenConns limits the number of connections used for reads. Zero means no limit.
+	MaxOpenConns int
+	// SeparatePools runs writes on a dedicated connection, which acquires the write lock at the beginning of
+	// each transaction, and reads on a pool of read-only connections. Otherwise, a single pool serves both.
+	SeparatePools bool
+	// GroupCommit commits the writes of concurrent callers in a single transaction, so that they share the cost
+	// of waiting for the data to reach the disk. Each write still succeeds or fails on its own.
+	GroupCommit bool
+}
+
+// DefaultOptions returns the options used by Open.
+func DefaultOptions() Options {
+	return Options{
+		JournalMode:   "WAL",
+		Synchronous:   "FULL",
+		BusyTimeout:   5 * time.Second,
+		SeparatePools: true,
+	}
+}
+
+var (
+	journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	syncLevels   = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+func oneOf(name, value string, allowed []string) error {
+	for _, v := range allowed {
+		if strings.EqualFold(v, value) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s %q (expected one of %s)", name, value, strings.Join(allowed, ", "))
+}
+
+// Validate reports the first invalid option, if any.
+func (o Options) Validate() error {
+	if err := oneOf("journal mode", o.JournalMode, journalModes); err != nil {
+		return err
+	}
+
+	if err := oneOf("synchronous level", o.Synchronous, syncLevels); err != nil {
+		return err
+	}
+
+	if o.BusyTimeout < 0 || o.CacheSize < 0 || o.MaxOpenConns < 0 {
+		return fmt.Errorf("busy timeout, cache size and max open connections cannot be negative")
+	}
+	return nil
+}
+
+// Names of the parameters of sqlite storage URLs, as in "sqlite:///var/lib/demo?journal_mode=wal&busy_timeout=10s".
+const (
+	journalModeParam   = "journal_mode"
+	synchronousParam   = "synchronous"
+	busyTimeoutParam   = "busy_timeout"
+	cacheSizeParam     = "cache_size"
+	maxOpenConnsParam  = "max_open_conns"
+	separatePoolsParam = "separate_pools"
+	groupCommitParam   = "group_commit"
+)
+
+// parseOptions overrides the default options with the given URL parameters.
+func parseOptions(params url.Values) (Options, error) {
+	o := DefaultOptions()
+
+	for name := range params {
+		value := params.Get(name)
+
+		var err error
+		switch name {
+		case journalModeParam:
+			o.JournalMode = value
+		case synchronousParam:
+			o.Synchronous = value
+		case busyTimeoutParam:
+			o.BusyTimeout, err = time.ParseDuration(value)
+		case cacheSizeParam:
+			o.CacheSize, err = strconv.Atoi(value)
+		case maxOpenConnsParam:
+			o.MaxOpenConns, err = strconv.Atoi(value)
+		case separatePoolsParam:
+			o.SeparatePools, err = strconv.ParseBool(value)
+		case groupCommitParam:
+			o.GroupCommit, err = strconv.ParseBool(value)
+		default:
+			return o, fmt.Errorf("unknown sqlite parameter %q", name)
+		}
+
+		if err != nil {
+			return o, fmt.Errorf("invalid value of sqlite parameter %q: %w", name, err)
+		}
+	}
+	return o, o.Validate()
+}
+
+// WithOptions returns a sqlite storage URL tuned by opts. Parameters already present in rawURL take precedence.
+// URLs of other backends are returned unchanged.
+func WithOptions(rawURL string, opts Options) (string, error) {
+	u, err := parseURL(rawURL)
+	if err != nil || u.Scheme != "sqlite" {
+		return rawURL, err
+	}
+
+	params := u.Query()
+	set := func(name, value string) {
+		if !params.Has(name) {
+			params.Set(name, value)
+		}
+	}
+
+	set(journalModeParam, opts.JournalMode)
+	set(synchronousParam, opts.Synchronous)
+	set(busyTimeoutParam, opts.BusyTimeout.String())
+	set(cacheSizeParam, strconv.Itoa(opts.CacheSize))
+	set(maxOpenConnsParam, strconv.Itoa(opts.MaxOpenConns))
+	set(separatePoolsParam, strconv.FormatBool(opts.SeparatePools))
+	set(groupCommitParam, strconv.FormatBool(opts.GroupCommit))
+
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
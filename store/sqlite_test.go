@@ -0,0 +1,642 @@
+//go:build cgo
+
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ostafen/demo/model"
+	"github.com/ostafen/demo/store"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenLegacyDatabase(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// create a database with the schema used before event metadata was introduced
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "data.mysqlite"))
+	require.NoError(t, err)
+
+	_, err = db.Exec(`CREATE TABLE event (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"type" TEXT NOT NULL,
+		"key" TEXT,
+		"value" TEXT NULL
+	);`)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`INSERT INTO event(type, key, value) VALUES
+		('create', 'a', '1'), ('create', 'b', '1'), ('update', 'a', '2'), ('delete', 'b', ''), ('create', 'b', '3')`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := store.Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	answ, err := s.GetAnswer("a")
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "a", Value: "2", Version: 2}, answ)
+
+	answ, err = s.GetAnswer("b")
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "b", Value: "3", Version: 3}, answ)
+
+	err = s.Update(&model.Answer{Key: "b", Value: "4"}, store.WithActor("alice"))
+	require.NoError(t, err)
+
+	it, err := s.GetHistory("b")
+	require.NoError(t, err)
+
+	ids := make([]int64, 0)
+	for it.Next() {
+		e, err := it.Value()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(ids)+1), e.Version)
+		ids = append(ids, e.ID)
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, []int64{2, 4, 5, 6}, ids)
+}
+
+func TestRebuild(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := store.Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	n := 100
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i % 10)
+
+		err := s.Create(&model.Answer{Key: key, Value: strconv.Itoa(i)})
+		if err == store.ErrAnswerExist {
+			if i%3 == 0 {
+				err = s.Delete(key)
+			} else {
+				err = s.Update(&model.Answer{Key: key, Value: strconv.Itoa(i)})
+			}
+		}
+		require.NoError(t, err)
+	}
+
+	answers := make(map[string]*model.Answer)
+	for i := 0; i < 10; i++ {
+		answ, err := s.GetAnswer(strconv.Itoa(i))
+		if err != store.ErrAnswerNotExist {
+			require.NoError(t, err)
+			answers[answ.Key] = answ
+		}
+	}
+
+	// wipe the projection behind the store's back
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "data.mysqlite"))
+	require.NoError(t, err)
+	_, err = db.Exec(`DELETE FROM answer`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = s.GetAnswer("0")
+	require.Equal(t, store.ErrAnswerNotExist, err)
+
+	require.NoError(t, s.Rebuild())
+
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+
+		answ, err := s.GetAnswer(key)
+		if answers[key] == nil {
+			require.Equal(t, store.ErrAnswerNotExist, err)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, answers[key], answ)
+		}
+	}
+
+	// versions of deleted answers are restored as well
+	all, err := readEvents(s.ReadAll(0, 0))
+	require.NoError(t, err)
+
+	last := all[len(all)-1]
+	if last.Event == model.DeleteEvent {
+		err = s.Create(&model.Answer{Key: last.Data.Key, Value: "value"}, store.WithExpectedVersion(last.Version))
+	} else {
+		err = s.Update(&model.Answer{Key: last.Data.Key, Value: "value"}, store.WithExpectedVersion(last.Version))
+	}
+	require.NoError(t, err)
+}
+
+func TestSearchIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := store.Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Create(&model.Answer{Key: "a", Value: "Hello World"}))
+	require.NoError(t, s.Create(&model.Answer{Key: "b", Value: "other"}))
+	require.NoError(t, s.Close())
+
+	// modify the answers as a build without FTS5 does, dropping the triggers maintaining the index, if any
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "data.mysqlite"))
+	require.NoError(t, err)
+	for _, trigger := range []string{"answer_fts_insert", "answer_fts_delete", "answer_fts_update"} {
+		_, err = db.Exec(`DROP TRIGGER IF EXISTS ` + trigger)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(`UPDATE answer SET value = 'another world' WHERE key = 'b'`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err = store.Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, query := range []string{"WORLD", "wo"} {
+		matches, _, err := s.ListAnswers(store.ListOptions{Query: query})
+		require.NoError(t, err)
+		require.Equal(t, []*model.Answer{{Key: "a", Value: "Hello World", Version: 1}, {Key: "b", Value: "another world", Version: 1}}, matches, query)
+	}
+
+	require.NoError(t, s.Update(&model.Answer{Key: "a", Value: "goodbye"}))
+
+	matches, _, err := s.ListAnswers(store.ListOptions{Query: "world"})
+	require.NoError(t, err)
+	require.Equal(t, []*model.Answer{{Key: "b", Value: "another world", Version: 1}}, matches)
+}
+
+func TestOpenURL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a plain path refers to a sqlite storage
+	s, err := store.OpenURL(dir)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.FileExists(t, filepath.Join(dir, "data.mysqlite"))
+
+	_, err = store.OpenURL("unknown://" + dir)
+	require.Error(t, err)
+
+	// characters with a special meaning in URIs are escaped in the sqlite file name
+	special := filepath.Join(dir, "a?b#c%41")
+	require.NoError(t, os.Mkdir(special, 0755))
+
+	s, err = store.OpenURL((&url.URL{Scheme: "sqlite", Path: special}).String())
+	require.NoError(t, err)
+	require.NoError(t, s.Create(&model.Answer{Key: "key", Value: "value"}))
+
+	var backup bytes.Buffer
+	require.NoError(t, s.Backup(&backup))
+	require.NoError(t, s.Close())
+	require.FileExists(t, filepath.Join(special, "data.mysqlite"))
+	require.NoFileExists(t, filepath.Join(dir, "a"))
+
+	// plain paths are not parsed as URLs
+	s, err = store.OpenURL(special)
+	require.NoError(t, err)
+
+	answ, err := s.GetAnswer("key")
+	require.NoError(t, err)
+	require.Equal(t, "value", answ.Value)
+	require.NoError(t, s.Close())
+
+	tenants, err := store.OpenTenants(special)
+	require.NoError(t, err)
+	defer tenants.Close()
+
+	_, err = tenants.Create(context.Background(), "acme")
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(special, "tenants", "acme", "data.mysqlite"))
+
+	// relative paths are resolved against the working directory
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	s, err = store.OpenURL("a?b#c%41")
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.GetAnswer("key")
+	require.NoError(t, err)
+
+	tenants, err = store.OpenTenants("a?b#c%41")
+	require.NoError(t, err)
+	defer tenants.Close()
+
+	_, err = tenants.Get(context.Background(), "acme")
+	require.NoError(t, err)
+}
+
+func latestSchemaVersion(t *testing.T) int {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	applied, err := store.Migrate(dir)
+	require.NoError(t, err)
+	return len(applied)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	status, err := store.GetSchemaStatus(dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, status.Version)
+	require.Empty(t, status.Applied)
+	require.NotEmpty(t, status.Pending)
+
+	latest := len(status.Pending)
+
+	// the status does not modify the database
+	status, err = store.GetSchemaStatus(dir)
+	require.NoError(t, err)
+	require.Len(t, status.Pending, latest)
+
+	applied, err := store.Migrate(dir)
+	require.NoError(t, err)
+	require.Len(t, applied, latest)
+
+	for i, m := range applied {
+		require.Equal(t, i+1, m.Version)
+	}
+
+	applied, err = store.Migrate(dir)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+
+	status, err = store.GetSchemaStatus(dir)
+	require.NoError(t, err)
+	require.Equal(t, latest, status.Version)
+	require.Len(t, status.Applied, latest)
+	require.Empty(t, status.Pending)
+}
+
+func TestMigrateFixtures(t *testing.T) {
+	latest := latestSchemaVersion(t)
+
+	fixtures := []struct {
+		file    string
+		version int
+	}{
+		{"sqlite_v3.sql", 3},
+		{"sqlite_unversioned.sql", latest},
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.file, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			schema, err := os.ReadFile(filepath.Join("testdata", fixture.file))
+			require.NoError(t, err)
+
+			db, err := sql.Open("sqlite3", filepath.Join(dir, "data.mysqlite"))
+			require.NoError(t, err)
+			_, err = db.Exec(string(schema))
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+
+			status, err := store.GetSchemaStatus(dir)
+			require.NoError(t, err)
+			require.Equal(t, fixture.version, status.Version)
+			require.Len(t, status.Pending, latest-fixture.version)
+
+			s, err := store.Open(dir)
+			require.NoError(t, err)
+
+			answ, err := s.GetAnswer("a")
+			require.NoError(t, err)
+			require.Equal(t, &model.Answer{Key: "a", Value: "2", Version: 2}, answ)
+
+			_, err = s.GetAnswer("b")
+			require.Equal(t, store.ErrAnswerNotExist, err)
+
+			err = s.Create(&model.Answer{Key: "b", Value: "3"}, store.WithActor("alice"))
+			require.NoError(t, err)
+
+			events, err := readEvents(s.GetHistory("b"))
+			require.NoError(t, err)
+			require.Len(t, events, 3)
+			require.Equal(t, int64(5), events[2].ID)
+			require.Equal(t, int64(3), events[2].Version)
+			require.Equal(t, "alice", events[2].Actor)
+			require.NoError(t, s.Close())
+
+			status, err = store.GetSchemaStatus(dir)
+			require.NoError(t, err)
+			require.Equal(t, latest, status.Version)
+			require.Len(t, status.Applied, latest)
+			require.Empty(t, status.Pending)
+		})
+	}
+}
+
+func TestMigrateLongStream(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	schema, err := os.ReadFile(filepath.Join("testdata", "sqlite_v1_long_stream.sql"))
+	require.NoError(t, err)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "data.mysqlite"))
+	require.NoError(t, err)
+	_, err = db.Exec(string(schema))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// the events of each stream are numbered in a single pass, rather than counting the previous ones for each event
+	start := time.Now()
+	s, err := store.Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Less(t, time.Since(start), 30*time.Second)
+
+	answ, err := s.GetAnswer("a")
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "a", Value: "100000", Version: 100001}, answ)
+
+	events, err := readEvents(s.GetHistory("b"))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, int64(2), events[1].Version)
+}
+
+func TestConcurrentOpen(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	n := 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			s, err := store.Open(dir)
+			if err == nil {
+				err = s.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	status, err := store.GetSchemaStatus(dir)
+	require.NoError(t, err)
+	require.Len(t, status.Applied, latestSchemaVersion(t))
+	require.Empty(t, status.Pending)
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// each store has its own connections, as if it was opened by a different process
+	n := 4
+	stores := make([]store.EventStore, n)
+	for i := range stores {
+		stores[i], err = store.Open(dir)
+		require.NoError(t, err)
+		defer stores[i].Close()
+	}
+
+	writes := 50
+	errs := make(chan error, 2*n)
+	for i, s := range stores {
+		go func(i int, s store.EventStore) {
+			for j := 0; j < writes; j++ {
+				key := "key-" + strconv.Itoa(i) + "-" + strconv.Itoa(j)
+				if err := s.Create(&model.Answer{Key: key, Value: "1"}); err != nil {
+					errs <- err
+					return
+				}
+
+				if err := s.Update(&model.Answer{Key: key, Value: "2"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i, s)
+
+		go func(s store.EventStore) {
+			for j := 0; j < writes; j++ {
+				if _, _, err := s.ListAnswers(store.ListOptions{Limit: 10}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(s)
+	}
+
+	for i := 0; i < 2*n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	answers, _, err := stores[0].ListAnswers(store.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, answers, n*writes)
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, params := range []string{
+		"journal_mode=wal&synchronous=normal&busy_timeout=10s&cache_size=4096&max_open_conns=4",
+		"journal_mode=delete&separate_pools=false",
+	} {
+		s, err := store.OpenURL("sqlite://" + dir + "?" + params)
+		require.NoError(t, err)
+
+		require.NoError(t, s.Create(&model.Answer{Key: params, Value: "1"}))
+
+		answ, err := s.GetAnswer(params)
+		require.NoError(t, err)
+		require.Equal(t, "1", answ.Value)
+		require.NoError(t, s.Close())
+	}
+
+	for _, params := range []string{"journal_mode=none", "busy_timeout=10", "cache_size=-1", "unknown=1"} {
+		_, err := store.OpenURL("sqlite://" + dir + "?" + params)
+		require.Error(t, err, params)
+	}
+
+	rawURL, err := store.WithOptions("sqlite://"+dir+"?synchronous=off", store.DefaultOptions())
+	require.NoError(t, err)
+
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	require.Equal(t, "off", u.Query().Get("synchronous"))
+	require.Equal(t, "WAL", u.Query().Get("journal_mode"))
+}
+
+func TestRestoreSQLiteBackup(t *testing.T) {
+	srcDir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(srcDir)
+
+	src, err := store.Open(srcDir)
+	require.NoError(t, err)
+	defer src.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, src.Create(&model.Answer{Key: strconv.Itoa(i), Value: "value"}))
+	}
+
+	var backup bytes.Buffer
+	require.NoError(t, src.Backup(&backup))
+	require.True(t, bytes.HasPrefix(backup.Bytes(), []byte("SQLite format 3")))
+
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dst, err := store.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, dst.Create(&model.Answer{Key: "existing", Value: "value"}))
+	require.NoError(t, dst.Close())
+
+	// a corrupted backup is rejected, and the storage is left untouched
+	corrupted := append([]byte{}, backup.Bytes()...)
+	for i := 4096; i < len(corrupted); i++ {
+		corrupted[i] = 0xff
+	}
+
+	_, err = store.RestoreBackup(dir, bytes.NewReader(corrupted))
+	require.Error(t, err)
+
+	// the database cannot be replaced while open, even if its connections hold no lock, as in rollback journal modes
+	dst, err = store.OpenURL("sqlite://" + dir + "?journal_mode=delete")
+	require.NoError(t, err)
+
+	_, err = dst.GetAnswer("existing")
+	require.NoError(t, err)
+
+	_, err = store.RestoreBackup(dir, bytes.NewReader(backup.Bytes()))
+	require.Equal(t, store.ErrStorageInUse, err)
+
+	_, err = dst.GetAnswer("existing")
+	require.NoError(t, err)
+	require.NoError(t, dst.Close())
+
+	// a valid backup replaces the database
+	n, err := store.RestoreBackup(dir, &backup)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+
+	dst, err = store.Open(dir)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	_, err = dst.GetAnswer("existing")
+	require.Equal(t, store.ErrAnswerNotExist, err)
+
+	events, err := readEvents(src.ReadAll(1, 0))
+	require.NoError(t, err)
+
+	restored, err := readEvents(dst.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.Equal(t, events, restored)
+}
+
+func TestEraseSQLiteFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := store.Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Create(&model.Answer{Key: strconv.Itoa(i), Value: "value"}))
+	}
+	require.NoError(t, s.Update(&model.Answer{Key: "5", Value: "s3cr3t-value"}))
+
+	_, err = s.Erase("5")
+	require.NoError(t, err)
+
+	// neither the database file nor its journals hold the erased value
+	require.False(t, sqliteFilesContain(t, dir, "s3cr3t"))
+}
+
+func TestEraseWithOpenReader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := store.DefaultOptions()
+	opts.BusyTimeout = 100 * time.Millisecond
+
+	s, err := store.OpenWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Create(&model.Answer{Key: strconv.Itoa(i), Value: "value"}))
+	}
+	require.NoError(t, s.Update(&model.Answer{Key: "5", Value: "s3cr3t-value"}))
+
+	// the open iterator prevents the write-ahead log, which holds the erased value, from being checkpointed
+	it, err := s.ReadAll(0, 0)
+	require.NoError(t, err)
+	require.True(t, it.Next())
+
+	e, err := s.Erase("5")
+	require.NoError(t, err)
+	require.Equal(t, model.EraseEvent, e.Event)
+	require.True(t, sqliteFilesContain(t, dir, "s3cr3t"))
+
+	// the checkpoint is retried in the background once the reader is gone
+	require.NoError(t, it.Close())
+	require.Eventually(t, func() bool {
+		return !sqliteFilesContain(t, dir, "s3cr3t")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// sqliteFilesContain reports whether the database file located in dir, or one of its journals, contains value.
+func sqliteFilesContain(t *testing.T, dir, value string) bool {
+	files, err := filepath.Glob(filepath.Join(dir, "data.mysqlite*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+
+		if bytes.Contains(data, []byte(value)) {
+			return true
+		}
+	}
+	return false
+}
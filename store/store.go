@@ -1,18 +1,304 @@
 package store
 
-import "github.com/ostafen/demo/model"
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
 
+	"github.com/ostafen/demo/model"
+)
+
+var (
+	ErrAnswerExist     = errors.New("an answer with the given key already exists")
+	ErrAnswerNotExist  = errors.New("no answer with the given key")
+	ErrVersionMismatch = errors.New("the answer version does not match the expected one")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+
+	ErrInvalidOperation     = errors.New("invalid operation")
+	ErrVersionNotExist      = errors.New("the answer has no such version")
+	ErrVersionNotRestorable = errors.New("the given version of the answer is a deletion and cannot be restored")
+	ErrBatchAborted         = errors.New("the batch has been aborted because one of its operations failed")
+)
+
+// isOperationError reports whether err is caused by an operation which is not allowed by the state of the store,
+// rather than by a failure of the store itself.
+func isOperationError(err error) bool {
+	switch err {
+	case ErrAnswerExist, ErrAnswerNotExist, ErrVersionMismatch, ErrInvalidOperation, ErrVersionNotExist, ErrVersionNotRestorable:
+		return true
+	}
+	return false
+}
+
+// EventStore is the interface implemented by storage backends. Methods performing I/O have a variant taking a context,
+// whose cancellation aborts the operation. Iterators returned by such variants stop when the context is cancelled.
 type EventStore interface {
-	Create(a *model.Answer) error
-	Update(a *model.Answer) error
-	Delete(key string) error
+	Create(a *model.Answer, opts ...WriteOption) error
+	CreateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error
+	Update(a *model.Answer, opts ...WriteOption) error
+	UpdateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error
+	Delete(key string, opts ...WriteOption) error
+	DeleteContext(ctx context.Context, key string, opts ...WriteOption) error
+	// Apply atomically executes a batch of operations: either all of them are applied, or none is.
+	// If an operation fails, ErrBatchAborted is returned, and the result of the failed operation holds its error.
+	Apply(ops []Operation, opts ...WriteOption) ([]OperationResult, error)
+	ApplyContext(ctx context.Context, ops []Operation, opts ...WriteOption) ([]OperationResult, error)
+	// Restore appends a restore event, reinstating the value the answer had at the given version.
+	// Deleted answers can be restored as well.
+	Restore(key string, toVersion int64, opts ...WriteOption) (*model.Answer, error)
+	RestoreContext(ctx context.Context, key string, toVersion int64, opts ...WriteOption) (*model.Answer, error)
 	GetAnswer(key string) (*model.Answer, error)
+	GetAnswerContext(ctx context.Context, key string) (*model.Answer, error)
+	GetAnswerAt(key string, asOf AsOf) (*model.Answer, error)
+	GetAnswerAtContext(ctx context.Context, key string, asOf AsOf) (*model.Answer, error)
+	// ListAnswers returns a page of the existing answers matching opts, together with the cursor
+	// of the next page, which is empty if no more answers are available.
+	ListAnswers(opts ListOptions) ([]*model.Answer, string, error)
+	ListAnswersContext(ctx context.Context, opts ListOptions) ([]*model.Answer, string, error)
 	GetHistory(key string) (EventIterator, error)
+	GetHistoryContext(ctx context.Context, key string) (EventIterator, error)
+	QueryHistory(key string, opts HistoryOptions) (EventIterator, error)
+	QueryHistoryContext(ctx context.Context, key string, opts HistoryOptions) (EventIterator, error)
+	// ReadAll returns the events of all the answers, in commit order, starting from the given sequence number (included).
+	// A zero limit returns all the remaining events.
+	ReadAll(fromSequence int64, limit int) (EventIterator, error)
+	ReadAllContext(ctx context.Context, fromSequence int64, limit int) (EventIterator, error)
+	// Subscribe notifies the events committed after the call. To get a gap-free stream of events,
+	// consumers should subscribe before replaying past events with ReadAll, and discard duplicates.
+	Subscribe() Subscription
+	// Rebuild recomputes the current state of all the answers by replaying the event log.
+	Rebuild() error
+	RebuildContext(ctx context.Context) error
+	// Backup writes a consistent copy of the storage to w, without interrupting the service. SQLite storages are copied
+	// as a SQLite database, other storages as an event log in the format of the file backend. See RestoreBackup.
+	Backup(w io.Writer) error
+	BackupContext(ctx context.Context, w io.Writer) error
+	// Compact removes the events which are not retained by policy.
+	Compact(policy RetentionPolicy) (CompactionReport, error)
+	CompactContext(ctx context.Context, policy RetentionPolicy) (CompactionReport, error)
+	// Erase permanently removes the events of an answer, deleted ones included, and records an erasure event in their place,
+	// which holds no value. The answer is left deleted. Only previous erasure events are kept, and they are never compacted.
+	// It returns the erasure event.
+	Erase(key string, opts ...WriteOption) (*model.Event, error)
+	EraseContext(ctx context.Context, key string, opts ...WriteOption) (*model.Event, error)
 	Close() error
 }
 
 type EventIterator interface {
+	// Next advances to the next event. It returns false when no more events are available,
+	// or when the iteration fails, as when the context of the iterator is cancelled.
 	Next() bool
 	Value() (*model.Event, error)
+	// Err returns the error which stopped the iteration, if any.
+	Err() error
 	Close() error
 }
+
+// contextStore holds the context-aware methods of EventStore.
+type contextStore interface {
+	CreateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error
+	UpdateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error
+	DeleteContext(ctx context.Context, key string, opts ...WriteOption) error
+	ApplyContext(ctx context.Context, ops []Operation, opts ...WriteOption) ([]OperationResult, error)
+	RestoreContext(ctx context.Context, key string, toVersion int64, opts ...WriteOption) (*model.Answer, error)
+	GetAnswerContext(ctx context.Context, key string) (*model.Answer, error)
+	GetAnswerAtContext(ctx context.Context, key string, asOf AsOf) (*model.Answer, error)
+	ListAnswersContext(ctx context.Context, opts ListOptions) ([]*model.Answer, string, error)
+	GetHistoryContext(ctx context.Context, key string) (EventIterator, error)
+	QueryHistoryContext(ctx context.Context, key string, opts HistoryOptions) (EventIterator, error)
+	ReadAllContext(ctx context.Context, fromSequence int64, limit int) (EventIterator, error)
+	RebuildContext(ctx context.Context) error
+	BackupContext(ctx context.Context, w io.Writer) error
+	CompactContext(ctx context.Context, policy RetentionPolicy) (CompactionReport, error)
+	EraseContext(ctx context.Context, key string, opts ...WriteOption) (*model.Event, error)
+}
+
+// background implements the methods of EventStore which do not take a context, by running their
+// context-aware variants with context.Background(). Backends embed it, so that they only implement the latter.
+type background struct {
+	s contextStore
+}
+
+func (b background) Create(a *model.Answer, opts ...WriteOption) error {
+	return b.s.CreateContext(context.Background(), a, opts...)
+}
+
+func (b background) Update(a *model.Answer, opts ...WriteOption) error {
+	return b.s.UpdateContext(context.Background(), a, opts...)
+}
+
+func (b background) Delete(key string, opts ...WriteOption) error {
+	return b.s.DeleteContext(context.Background(), key, opts...)
+}
+
+func (b background) Apply(ops []Operation, opts ...WriteOption) ([]OperationResult, error) {
+	return b.s.ApplyContext(context.Background(), ops, opts...)
+}
+
+func (b background) Restore(key string, toVersion int64, opts ...WriteOption) (*model.Answer, error) {
+	return b.s.RestoreContext(context.Background(), key, toVersion, opts...)
+}
+
+func (b background) GetAnswer(key string) (*model.Answer, error) {
+	return b.s.GetAnswerContext(context.Background(), key)
+}
+
+func (b background) GetAnswerAt(key string, asOf AsOf) (*model.Answer, error) {
+	return b.s.GetAnswerAtContext(context.Background(), key, asOf)
+}
+
+func (b background) ListAnswers(opts ListOptions) ([]*model.Answer, string, error) {
+	return b.s.ListAnswersContext(context.Background(), opts)
+}
+
+func (b background) GetHistory(key string) (EventIterator, error) {
+	return b.s.GetHistoryContext(context.Background(), key)
+}
+
+func (b background) QueryHistory(key string, opts HistoryOptions) (EventIterator, error) {
+	return b.s.QueryHistoryContext(context.Background(), key, opts)
+}
+
+func (b background) ReadAll(fromSequence int64, limit int) (EventIterator, error) {
+	return b.s.ReadAllContext(context.Background(), fromSequence, limit)
+}
+
+func (b background) Rebuild() error {
+	return b.s.RebuildContext(context.Background())
+}
+
+func (b background) Backup(w io.Writer) error {
+	return b.s.BackupContext(context.Background(), w)
+}
+
+func (b background) Compact(policy RetentionPolicy) (CompactionReport, error) {
+	return b.s.CompactContext(context.Background(), policy)
+}
+
+func (b background) Erase(key string, opts ...WriteOption) (*model.Event, error) {
+	return b.s.EraseContext(context.Background(), key, opts...)
+}
+
+// AsOf identifies a point in the history of the store, either by event sequence number or by time.
+// The zero value refers to the latest state of the store.
+type AsOf struct {
+	Sequence int64
+	Time     time.Time
+}
+
+// AtSequence refers to the state of the store right after the event with the given sequence number has been recorded.
+func AtSequence(seq int64) AsOf {
+	return AsOf{Sequence: seq}
+}
+
+// AtTime refers to the state of the store at time t.
+func AtTime(t time.Time) AsOf {
+	return AsOf{Time: t}
+}
+
+// HistoryOptions filters and paginates the events returned by QueryHistory.
+// The zero value selects the whole history of an answer, in ascending sequence order.
+type HistoryOptions struct {
+	// After is a cursor pointing to the sequence number of the last event of the previous page:
+	// only events following it (in the requested order) are returned.
+	After int64
+	// Limit is the maximum number of events to return. Zero means no limit.
+	Limit int
+	// Types restricts the result to events of the given types.
+	Types []model.EventType
+	// From and To restrict the result to events recorded in the [From, To) time range.
+	// A zero value leaves the corresponding side of the range unbounded.
+	From time.Time
+	To   time.Time
+	// Descending returns the most recent events first.
+	Descending bool
+}
+
+// SortField is the field answers are sorted by in ListAnswers.
+type SortField string
+
+const (
+	SortByKey SortField = "key"
+	// SortByUpdate sorts answers by the time of their last modification.
+	SortByUpdate SortField = "updated"
+)
+
+// ListOptions filters, sorts and paginates the answers returned by ListAnswers.
+type ListOptions struct {
+	// Prefix restricts the result to answers whose key starts with the given prefix.
+	Prefix string
+	// Query restricts the result to answers whose value contains the given string (case-insensitive).
+	Query string
+	// SortBy defaults to SortByKey.
+	SortBy     SortField
+	Descending bool
+	// Limit is the maximum number of answers to return. Zero means no limit.
+	Limit int
+	// Cursor is the opaque cursor returned along with the previous page.
+	Cursor string
+}
+
+// Operation is a single write executed as part of a batch by Apply.
+type Operation struct {
+	// Type is either CreateEvent, UpdateEvent, DeleteEvent or RestoreEvent.
+	Type model.EventType
+	// Answer is the answer to create or update (only the key is relevant for deletes and restores).
+	// On success, it is set to the state of the answer produced by the operation.
+	Answer *model.Answer
+	// ExpectedVersion makes the batch fail with ErrVersionMismatch if the answer version is different.
+	// Operations on the same key are applied in order, so later operations observe the effect of earlier ones.
+	ExpectedVersion int64
+	// RestoreVersion is the version whose value is reinstated by a RestoreEvent operation.
+	RestoreVersion int64
+}
+
+// OperationResult is the outcome of an operation executed by Apply.
+type OperationResult struct {
+	// Version is the version of the answer after the operation has been applied.
+	Version int64
+	// Err is ErrBatchAborted for operations which have not been applied because of the failure of another operation.
+	Err error
+}
+
+// AnyVersion disables the optimistic concurrency check of a write operation.
+const AnyVersion int64 = 0
+
+type writeOptions struct {
+	expectedVersion int64
+	actor           string
+	metadata        map[string]string
+}
+
+// WriteOption customizes the behaviour of Create, Update, Delete and Erase.
+type WriteOption func(*writeOptions)
+
+// WithExpectedVersion makes a write operation fail with ErrVersionMismatch
+// if the current version of the answer stream is not equal to version.
+func WithExpectedVersion(version int64) WriteOption {
+	return func(o *writeOptions) {
+		o.expectedVersion = version
+	}
+}
+
+// WithActor records the principal performing a write operation on the resulting event.
+func WithActor(actor string) WriteOption {
+	return func(o *writeOptions) {
+		o.actor = actor
+	}
+}
+
+// WithMetadata attaches free-form metadata (such as a request id or the client address) to the resulting event.
+func WithMetadata(metadata map[string]string) WriteOption {
+	return func(o *writeOptions) {
+		o.metadata = metadata
+	}
+}
+
+func applyWriteOptions(opts []WriteOption) *writeOptions {
+	o := &writeOptions{expectedVersion: AnyVersion}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -1,177 +1,438 @@
 package store
 
 import (
+	"context"
 	"database/sql"
-	"errors"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
-	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ostafen/demo/model"
-
-	_ "github.com/mattn/go-sqlite3" // Import go-sqlite3 library
-)
-
-var (
-	ErrAnswerExist    = errors.New("an answer with the given key already exists")
-	ErrAnswerNotExist = errors.New("no answer with the given key")
 )
 
-const dbFilename = "./data.mysqlite"
+// dialect captures the differences between the SQL databases storeImpl can run on.
+type dialect struct {
+	// placeholder returns the placeholder of the n-th (1-based) parameter of a query.
+	placeholder func(n int) string
+	// lockStmt, if not empty, is executed at the beginning of each write transaction, to serialize
+	// writers running in different processes, so that events become visible in sequence order.
+	lockStmt string
+	// syncSequenceStmt, if not empty, realigns the generator of sequence numbers after events have been inserted with explicit ones.
+	syncSequenceStmt string
+
+	// migrations is the directory of the migrations of the dialect.
+	migrations string
+	// beginMigration starts the transaction of a migration, and acquires an exclusive lock on the database.
+	beginMigration []string
+	tableExists    func(ctx context.Context, conn *sql.Conn, table string) (bool, error)
+	// detectVersion, if not nil, returns the schema version of a database created before migrations were introduced.
+	detectVersion func(ctx context.Context, conn *sql.Conn) (int, error)
+	// backup, if not nil, copies the database to w. Otherwise, backups are written in the format of the log of the file backend.
+	backup func(ctx context.Context, s *storeImpl, w io.Writer) error
+	// vacuum releases the space freed by deleted rows to the file system.
+	vacuum []string
+	// sizeQuery returns the size of the database, in bytes.
+	sizeQuery string
+	// purge, if not nil, discards the copies of the erased rows which the database keeps outside of its tables.
+	// It runs after an erasure is committed, and is retried in the background until it succeeds.
+	purge func(ctx context.Context, s *storeImpl) error
+	// prepare, if not nil, completes the schema of an upgraded database with the parts which depend on the build,
+	// such as the full-text index of sqlite storages.
+	prepare func(ctx context.Context, s *storeImpl) error
+	// searchCondition, if not nil, returns an indexed condition selecting the answers whose value contains query,
+	// or an empty condition if the index cannot serve the query.
+	searchCondition func(query string) (string, []any)
+}
 
+// storeImpl is an EventStore on top of a SQL database. Queries are written with "?" placeholders,
+// and translated to the syntax of the database by rebind.
 type storeImpl struct {
+	background
+
 	path string
 	db   *sql.DB
+	// readDB serves queries which do not modify the database. It may be the same as db.
+	readDB  *sql.DB
+	dialect *dialect
+
+	// lock, if not nil, is a shared lock on the storage, held while it is open so that it is not replaced meanwhile.
+	lock *os.File
+
+	// writeMu serializes write transactions, so that events are published in commit order.
+	writeMu sync.Mutex
+	broker  *broker
+
+	// groupCommit commits the writes of concurrent callers in a single transaction.
+	// Writes waiting for the transaction are queued in queue.
+	groupCommit bool
+	queueMu     sync.Mutex
+	queue       []*writeRequest
+
+	// purgeMu guards the retries of a failed purge, which run in the background until the store is closed.
+	purgeMu sync.Mutex
+	// purging is set while the retries run, and purgePending while a purge has failed since the last retry.
+	purging      bool
+	purgePending bool
+	closed       bool
+	stopPurge    chan struct{}
+	purgeWG      sync.WaitGroup
 }
 
-func createDBFileIfNotExists(fileName string) error {
-	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0666) // Create SQLite file
-	if err != nil && err != os.ErrExist {
-		return err
+func (s *storeImpl) rebind(query string) string {
+	return s.dialect.rebind(query)
+}
+
+// rebind replaces the "?" placeholders of query with the ones of the dialect.
+func (d *dialect) rebind(query string) string {
+	if d.placeholder == nil {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString(d.placeholder(n))
+			continue
+		}
+		b.WriteRune(c)
 	}
-	return file.Close()
+	return b.String()
 }
 
-func (s *storeImpl) init() error {
-	tx, err := s.db.Begin()
+// beginWrite starts a write transaction. The caller must hold writeMu. It fails if ctx has been cancelled
+// while waiting for other writers.
+func (s *storeImpl) beginWrite(ctx context.Context) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return nil, err
+	}
+
+	if s.dialect.lockStmt != "" {
+		if _, err := tx.ExecContext(ctx, s.dialect.lockStmt); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// rebuildAnswers recomputes the answer table by replaying the event log.
+func (s *storeImpl) rebuildAnswers(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM answer`); err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	createTableStmt := `CREATE TABLE IF NOT EXISTS event (
-		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,		
-		"type" TEXT NOT NULL,
-		"key" TEXT,
-		"value" TEXT NULL
-	  );`
+	rebuildStmt := `INSERT INTO answer(key, value, version, deleted, event_id, timestamp)
+		SELECT key, value, version, type IN ((?), (?)), id, timestamp FROM event
+		WHERE id IN (SELECT MAX(id) FROM event GROUP BY key)`
+
+	_, err := tx.ExecContext(ctx, s.rebind(rebuildStmt), model.DeleteEvent, model.EraseEvent)
+	return err
+}
+
+func (s *storeImpl) RebuildContext(ctx context.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
 
-	_, err = tx.Exec(createTableStmt)
+	tx, err := s.beginWrite(ctx)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// since the table can grow a lot, we create an index on the key field to speed-up search queries
-	createIndexStmt := `CREATE INDEX IF NOT EXISTS key_index ON event(key);`
-	_, err = tx.Exec(createIndexStmt)
-	if err != nil {
+	if err := s.rebuildAnswers(ctx, tx); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func Open(dir string) (EventStore, error) {
-	dbPath := path.Join(dir, dbFilename)
+// insertEvent records e in the event table. New events are assigned their sequence number and timestamp,
+// while events copied from another store, which already have a sequence number, are recorded as they are.
+func (s *storeImpl) insertEvent(ctx context.Context, e *model.Event, txn *sql.Tx) error {
+	var metadata sql.NullString
+	if len(e.Metadata) > 0 {
+		data, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = sql.NullString{String: string(data), Valid: true}
+	}
 
-	if err := createDBFileIfNotExists(dbPath); err != nil {
-		return nil, err
+	if e.ID == 0 {
+		e.Timestamp = unixNanoToTime(time.Now().UnixNano())
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
+	var timestamp int64
+	if !e.Timestamp.IsZero() {
+		timestamp = e.Timestamp.UnixNano()
 	}
 
-	store := &storeImpl{
-		path: dbPath,
-		db:   db,
+	columns := `type, key, value, version, timestamp, actor, metadata`
+	args := []any{e.Event, e.Data.Key, e.Data.Value, e.Version, timestamp, sql.NullString{String: e.Actor, Valid: e.Actor != ""}, metadata}
+	if e.ID != 0 {
+		columns = `id, ` + columns
+		args = append([]any{e.ID}, args...)
 	}
 
-	err = store.init()
-	return store, err
-}
+	insertStmt := fmt.Sprintf(`INSERT INTO event(%s) VALUES (%s) RETURNING id`, columns, strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", "))
 
-func (s *storeImpl) insertEvent(t model.EventType, a *model.Answer, txn *sql.Tx) error {
-	insertStmt := `INSERT INTO event(type, key, value) VALUES (?, ?, ?)`
-	_, err := txn.Exec(insertStmt, t, a.Key, a.Value)
+	if err := txn.QueryRowContext(ctx, s.rebind(insertStmt), args...).Scan(&e.ID); err != nil {
+		return err
+	}
+
+	upsertStmt := `INSERT INTO answer(key, value, version, deleted, event_id, timestamp) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, version = excluded.version, deleted = excluded.deleted,
+		event_id = excluded.event_id, timestamp = excluded.timestamp`
+
+	_, err := txn.ExecContext(ctx, s.rebind(upsertStmt), e.Data.Key, e.Data.Value, e.Version, removesAnswer(e.Event), e.ID, timestamp)
 	return err
 }
 
-func (s *storeImpl) Create(a *model.Answer) error {
-	tx, err := s.db.Begin()
+// appendEvents records events produced by another store, preserving their sequence numbers.
+func (s *storeImpl) appendEvents(ctx context.Context, events []*model.Event) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.beginWrite(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	_, err = s.getAnswer(a.Key, tx)
-	if err == nil {
-		return ErrAnswerExist
+	var lastID int64
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM event`).Scan(&lastID); err != nil {
+		return err
 	}
 
-	if err != ErrAnswerNotExist {
-		return err
+	for _, e := range events {
+		if err := checkAppended(e, lastID); err != nil {
+			return err
+		}
+
+		if err := s.insertEvent(ctx, e, tx); err != nil {
+			return err
+		}
+		lastID = e.ID
+	}
+
+	if s.dialect.syncSequenceStmt != "" {
+		if _, err := tx.ExecContext(ctx, s.dialect.syncSequenceStmt); err != nil {
+			return err
+		}
 	}
 
-	if err := s.insertEvent(model.CreateEvent, a, tx); err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
-	return tx.Commit()
+
+	s.broker.publish(events...)
+	return nil
 }
 
-func (s *storeImpl) Update(a *model.Answer) error {
-	tx, err := s.db.Begin()
+// applyOperation appends the event produced by op to the stream of its answer, after checking that the
+// operation is allowed by the current state of the answer. The event is not visible until tx is committed.
+func (s *storeImpl) applyOperation(ctx context.Context, op *Operation, o *writeOptions, tx *sql.Tx) (*model.Event, error) {
+	if op.Answer == nil {
+		return nil, ErrInvalidOperation
+	}
+
+	snap, err := s.getSnapshot(ctx, op.Answer.Key, tx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback()
 
-	_, err = s.getAnswer(a.Key, tx)
+	e, err := nextEvent(op, snap, o, func(key string, version int64) (string, error) {
+		return s.restoredValue(ctx, key, version, tx)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := s.insertEvent(model.UpdateEvent, a, tx); err != nil {
-		return err
+	if err := s.insertEvent(ctx, e, tx); err != nil {
+		return nil, err
 	}
-	return tx.Commit()
+	return e, nil
+}
+
+// applyOperations applies a batch of operations within tx, and returns the events they produce.
+func (s *storeImpl) applyOperations(ctx context.Context, ops []Operation, o *writeOptions, tx *sql.Tx) ([]*model.Event, []OperationResult, error) {
+	results := make([]OperationResult, len(ops))
+	events := make([]*model.Event, 0, len(ops))
+	for i := range ops {
+		e, err := s.applyOperation(ctx, &ops[i], o, tx)
+		if isOperationError(err) {
+			return nil, abortedResults(len(ops), i, err), ErrBatchAborted
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		results[i].Version = e.Version
+		events = append(events, e)
+	}
+	return events, results, nil
 }
 
-func (s *storeImpl) Delete(key string) error {
-	tx, err := s.db.Begin()
+func (s *storeImpl) ApplyContext(ctx context.Context, ops []Operation, opts ...WriteOption) ([]OperationResult, error) {
+	o := applyWriteOptions(opts)
+
+	if s.groupCommit {
+		return s.applyGrouped(ctx, ops, o)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.beginWrite(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	_, err = s.getAnswer(key, tx)
+	events, results, err := s.applyOperations(ctx, ops, o, tx)
 	if err != nil {
-		return err
+		return results, err
 	}
 
-	if err := s.insertEvent(model.DeleteEvent, &model.Answer{Key: key}, tx); err != nil {
-		return err
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-	return tx.Commit()
+
+	for i := range ops {
+		*ops[i].Answer = *events[i].Data
+	}
+
+	s.broker.publish(events...)
+	return results, nil
+}
+
+// restoredValue returns the value held by the answer with the given key at the given version.
+func (s *storeImpl) restoredValue(ctx context.Context, key string, version int64, tx *sql.Tx) (string, error) {
+	query := selectEventColumns + ` WHERE key = (?) AND version = (?)`
+
+	e, err := s.queryEvent(ctx, tx, query, key, version)
+	if err != nil {
+		return "", err
+	}
+
+	if e == nil {
+		return "", ErrVersionNotExist
+	}
+
+	if removesAnswer(e.Event) {
+		return "", ErrVersionNotRestorable
+	}
+	return e.Data.Value, nil
 }
 
+func (s *storeImpl) RestoreContext(ctx context.Context, key string, toVersion int64, opts ...WriteOption) (*model.Answer, error) {
+	return restoreAnswer(ctx, s, key, toVersion, opts)
+}
+
+func (s *storeImpl) CreateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error {
+	return writeAnswer(ctx, s, model.CreateEvent, a, opts)
+}
+
+func (s *storeImpl) UpdateContext(ctx context.Context, a *model.Answer, opts ...WriteOption) error {
+	return writeAnswer(ctx, s, model.UpdateEvent, a, opts)
+}
+
+func (s *storeImpl) DeleteContext(ctx context.Context, key string, opts ...WriteOption) error {
+	return writeAnswer(ctx, s, model.DeleteEvent, &model.Answer{Key: key}, opts)
+}
+
+const selectEventColumns = `SELECT id, type, key, value, version, timestamp, actor, metadata FROM event`
+
 func scanEvent[T interface{ Scan(dest ...any) error }](row T) (*model.Event, error) {
-	var id int
+	var id, version, timestamp int64
 	var evtType, key, value string
+	var actor, metadata sql.NullString
 
-	err := row.Scan(&id, &evtType, &key, &value)
-	return &model.Event{
-		Event: model.EventType(evtType),
-		Data:  &model.Answer{Key: key, Value: value},
-	}, err
+	if err := row.Scan(&id, &evtType, &key, &value, &version, &timestamp, &actor, &metadata); err != nil {
+		return nil, err
+	}
+
+	e := &model.Event{
+		ID:        id,
+		Event:     model.EventType(evtType),
+		Version:   version,
+		Timestamp: unixNanoToTime(timestamp),
+		Actor:     actor.String,
+		Data:      &model.Answer{Key: key, Value: value, Version: version},
+	}
+
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &e.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
-func (s *storeImpl) GetAnswer(key string) (*model.Answer, error) {
-	txn, err := s.db.Begin()
+func unixNanoToTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+func (s *storeImpl) GetAnswerContext(ctx context.Context, key string) (*model.Answer, error) {
+	txn, err := s.readDB.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer txn.Rollback()
 
-	answ, err := s.getAnswer(key, txn)
+	answ, err := s.getAnswer(ctx, key, txn)
 	if err != nil {
 		return nil, err
 	}
 	return answ, nil
 }
 
-func (s *storeImpl) getAnswer(key string, tx *sql.Tx) (*model.Answer, error) {
-	query := `SELECT * FROM event WHERE key = (?) ORDER BY id DESC LIMIT 1`
-	row := tx.QueryRow(query, key)
+func (s *storeImpl) GetAnswerAtContext(ctx context.Context, key string, asOf AsOf) (*model.Answer, error) {
+	txn, err := s.readDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	var e *model.Event
+	switch {
+	case asOf.Sequence > 0:
+		query := selectEventColumns + ` WHERE key = (?) AND id <= (?) ORDER BY id DESC LIMIT 1`
+		e, err = s.queryEvent(ctx, txn, query, key, asOf.Sequence)
+	case !asOf.Time.IsZero():
+		query := selectEventColumns + ` WHERE key = (?) AND timestamp <= (?) ORDER BY id DESC LIMIT 1`
+		e, err = s.queryEvent(ctx, txn, query, key, asOf.Time.UnixNano())
+	default:
+		return s.getAnswer(ctx, key, txn)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if e == nil || removesAnswer(e.Event) {
+		return nil, ErrAnswerNotExist
+	}
+	return e.Data, nil
+}
+
+// queryEvent returns the event selected by query, or nil if no event matches it.
+func (s *storeImpl) queryEvent(ctx context.Context, tx *sql.Tx, query string, args ...any) (*model.Event, error) {
+	row := tx.QueryRowContext(ctx, s.rebind(query), args...)
 
 	if row.Err() != nil {
 		return nil, row.Err()
@@ -179,31 +440,510 @@ func (s *storeImpl) getAnswer(key string, tx *sql.Tx) (*model.Answer, error) {
 
 	e, err := scanEvent(row)
 	if err == sql.ErrNoRows {
-		return nil, ErrAnswerNotExist
+		return nil, nil
 	}
+	return e, err
+}
+
+// search returns the condition selecting the answers whose value contains query, ignoring case. Without an index,
+// the answer table is scanned.
+func (d *dialect) search(query string) (string, []any) {
+	if d.searchCondition != nil {
+		if condition, args := d.searchCondition(query); condition != "" {
+			return condition, args
+		}
+	}
+	return `lower(value) LIKE lower(?) ESCAPE '\'`, []any{"%" + likeEscaper.Replace(query) + "%"}
+}
 
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *storeImpl) ListAnswersContext(ctx context.Context, opts ListOptions) ([]*model.Answer, string, error) {
+	conditions := []string{`NOT deleted`}
+	args := []any{}
+
+	if opts.Prefix != "" {
+		conditions = append(conditions, `key >= (?)`)
+		args = append(args, opts.Prefix)
+
+		if upper := prefixUpperBound(opts.Prefix); upper != "" {
+			conditions = append(conditions, `key < (?)`)
+			args = append(args, upper)
+		}
+	}
+
+	if opts.Query != "" {
+		condition, condArgs := s.dialect.search(opts.Query)
+		conditions = append(conditions, condition)
+		args = append(args, condArgs...)
+	}
+
+	column := "key"
+	if opts.SortBy == SortByUpdate {
+		column = "event_id"
+	} else if opts.SortBy != "" && opts.SortBy != SortByKey {
+		return nil, "", fmt.Errorf("unknown sort field %q", opts.SortBy)
+	}
+
+	order, cmp := "ASC", ">"
+	if opts.Descending {
+		order, cmp = "DESC", "<"
+	}
+
+	if opts.Cursor != "" {
+		cursor, err := decodeListCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		conditions = append(conditions, fmt.Sprintf(`%s %s (?)`, column, cmp))
+		if column == "key" {
+			args = append(args, cursor.Key)
+		} else {
+			args = append(args, cursor.EventID)
+		}
+	}
+
+	query := fmt.Sprintf(`SELECT key, value, version, event_id FROM answer WHERE %s ORDER BY %s %s`,
+		strings.Join(conditions, " AND "), column, order)
+
+	// fetch one more answer than requested, to find out whether a next page exists
+	if opts.Limit > 0 {
+		query += ` LIMIT (?)`
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := s.readDB.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	answers := make([]*model.Answer, 0)
+	var lastEventID int64
+	for rows.Next() {
+		if opts.Limit > 0 && len(answers) == opts.Limit {
+			cursor := &listCursor{Key: answers[len(answers)-1].Key}
+			if column == "event_id" {
+				cursor = &listCursor{EventID: lastEventID}
+			}
+			return answers, cursor.encode(), nil
+		}
+
+		answ := &model.Answer{}
+		if err := rows.Scan(&answ.Key, &answ.Value, &answ.Version, &lastEventID); err != nil {
+			return nil, "", err
+		}
+		answers = append(answers, answ)
+	}
+	return answers, "", rows.Err()
+}
+
+// getSnapshot returns the latest state of the answer with the given key, or nil if no event has ever been recorded for it.
+func (s *storeImpl) getSnapshot(ctx context.Context, key string, tx *sql.Tx) (*snapshot, error) {
+	query := `SELECT value, version, deleted, event_id FROM answer WHERE key = (?)`
+
+	snap := &snapshot{answer: &model.Answer{Key: key}}
+	err := tx.QueryRowContext(ctx, s.rebind(query), key).Scan(&snap.answer.Value, &snap.answer.Version, &snap.deleted, &snap.eventID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *storeImpl) getAnswer(ctx context.Context, key string, tx *sql.Tx) (*model.Answer, error) {
+	snap, err := s.getSnapshot(ctx, key, tx)
 	if err != nil {
 		return nil, err
 	}
 
-	if e.Event == model.DeleteEvent {
+	if snap == nil || snap.deleted {
 		return nil, ErrAnswerNotExist
 	}
+	return snap.answer, nil
+}
 
-	return e.Data, err
+func (s *storeImpl) Subscribe() Subscription {
+	return s.broker.subscribe()
 }
 
 func (s *storeImpl) Close() error {
-	return s.db.Close()
+	s.purgeMu.Lock()
+	s.closed = true
+	if s.stopPurge != nil {
+		close(s.stopPurge)
+	}
+	s.purgeMu.Unlock()
+	s.purgeWG.Wait()
+
+	s.broker.close()
+	if s.readDB != s.db {
+		s.readDB.Close()
+	}
+
+	err := s.db.Close()
+	if s.lock != nil {
+		if lockErr := s.lock.Close(); err == nil {
+			err = lockErr
+		}
+	}
+	return err
 }
 
-func (s *storeImpl) GetHistory(key string) (EventIterator, error) {
-	query := `SELECT * FROM event WHERE key = (?) ORDER BY id ASC`
-	rows, err := s.db.Query(query, key)
+func (s *storeImpl) GetHistoryContext(ctx context.Context, key string) (EventIterator, error) {
+	return s.QueryHistoryContext(ctx, key, HistoryOptions{})
+}
+
+func (s *storeImpl) QueryHistoryContext(ctx context.Context, key string, opts HistoryOptions) (EventIterator, error) {
+	conditions := []string{`key = (?)`}
+	args := []any{key}
+
+	if opts.After > 0 {
+		if opts.Descending {
+			conditions = append(conditions, `id < (?)`)
+		} else {
+			conditions = append(conditions, `id > (?)`)
+		}
+		args = append(args, opts.After)
+	}
+
+	if len(opts.Types) > 0 {
+		placeholders := make([]string, len(opts.Types))
+		for i, t := range opts.Types {
+			placeholders[i] = "?"
+			args = append(args, t)
+		}
+		conditions = append(conditions, fmt.Sprintf(`type IN (%s)`, strings.Join(placeholders, ", ")))
+	}
+
+	if !opts.From.IsZero() {
+		conditions = append(conditions, `timestamp >= (?)`)
+		args = append(args, opts.From.UnixNano())
+	}
+
+	if !opts.To.IsZero() {
+		conditions = append(conditions, `timestamp < (?)`)
+		args = append(args, opts.To.UnixNano())
+	}
+
+	order := "ASC"
+	if opts.Descending {
+		order = "DESC"
+	}
+
+	query := fmt.Sprintf(`%s WHERE %s ORDER BY id %s`, selectEventColumns, strings.Join(conditions, " AND "), order)
+	if opts.Limit > 0 {
+		query += ` LIMIT (?)`
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.readDB.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rowIterator{
+		rows: rows,
+	}, nil
+}
+
+func (s *storeImpl) ReadAllContext(ctx context.Context, fromSequence int64, limit int) (EventIterator, error) {
+	query := selectEventColumns + ` WHERE id >= (?) ORDER BY id ASC`
+	args := []any{fromSequence}
+
+	if limit > 0 {
+		query += ` LIMIT (?)`
+		args = append(args, limit)
+	}
+
+	rows, err := s.readDB.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
 
 	return &rowIterator{
 		rows: rows,
-	}, err
+	}, nil
+}
+
+func (s *storeImpl) BackupContext(ctx context.Context, w io.Writer) error {
+	if s.dialect.backup != nil {
+		return s.dialect.backup(ctx, s, w)
+	}
+
+	// a repeatable read transaction sees a consistent snapshot of the event log, while writes go on
+	tx, err := s.readDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, selectEventColumns+` ORDER BY id ASC`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return writeLog(w, &rowIterator{rows: rows})
+}
+
+// removableEvents selects the id and key of the events which are not retained by a retention policy,
+// where pos is the position of each event in the history of its answer, starting from 1 for the most recent.
+const removableEvents = `SELECT id, key FROM (
+	SELECT id, key, timestamp, ROW_NUMBER() OVER (PARTITION BY key ORDER BY id DESC) AS pos FROM event
+) ranked WHERE pos > 1`
+
+func (s *storeImpl) CompactContext(ctx context.Context, policy RetentionPolicy) (CompactionReport, error) {
+	var report CompactionReport
+	if err := policy.Validate(); err != nil {
+		return report, err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	sizeBefore, err := s.size(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	tx, err := s.beginWrite(ctx)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if policy.PurgeDeletedAfter > 0 {
+		if err := s.purgeDeleted(ctx, tx, now.Add(-policy.PurgeDeletedAfter), &report); err != nil {
+			return report, err
+		}
+	}
+
+	if policy.KeepLast > 0 || policy.KeepFor > 0 {
+		if err := s.removeEvents(ctx, tx, policy, now, &report); err != nil {
+			return report, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return CompactionReport{}, err
+	}
+
+	if policy.Vacuum {
+		for _, stmt := range s.dialect.vacuum {
+			if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	sizeAfter, err := s.size(ctx)
+	report.ReclaimedBytes = sizeBefore - sizeAfter
+	return report, err
+}
+
+// purgeDeleted removes the history of the answers deleted before cutoff, except for the one holding the last event of the log,
+// and the ones holding erasure events.
+func (s *storeImpl) purgeDeleted(ctx context.Context, tx *sql.Tx, cutoff time.Time, report *CompactionReport) error {
+	purged := `SELECT key FROM answer WHERE deleted AND timestamp < (?) AND event_id < (SELECT MAX(id) FROM event)
+		AND key NOT IN (SELECT key FROM event WHERE type = (?))`
+
+	res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM event WHERE key IN (`+purged+`)`), cutoff.UnixNano(), model.EraseEvent)
+	if err != nil {
+		return err
+	}
+
+	if report.RemovedEvents, err = res.RowsAffected(); err != nil {
+		return err
+	}
+
+	res, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM answer WHERE key IN (`+purged+`)`), cutoff.UnixNano(), model.EraseEvent)
+	if err != nil {
+		return err
+	}
+
+	report.PurgedAnswers, err = res.RowsAffected()
+	return err
+}
+
+// removeEvents removes the events which are not retained by policy. The last answer event and erasure events
+// are never removed, so that the answer table is not affected.
+func (s *storeImpl) removeEvents(ctx context.Context, tx *sql.Tx, policy RetentionPolicy, now time.Time, report *CompactionReport) error {
+	removable := removableEvents
+	var args []any
+
+	if policy.KeepLast > 0 {
+		removable += ` AND pos > (?)`
+		args = append(args, policy.KeepLast)
+	}
+
+	if policy.KeepFor > 0 {
+		removable += ` AND timestamp < (?)`
+		args = append(args, now.Add(-policy.KeepFor).UnixNano())
+	}
+
+	deleteStmt := `WITH removable AS (` + removable + `) DELETE FROM event WHERE id IN (SELECT id FROM removable) AND type <> (?)`
+	deleteArgs := append(append([]any{}, args...), model.EraseEvent)
+
+	if policy.Snapshot {
+		// the last removable event of each answer is kept, and turned into a snapshot (unless it is a deletion)
+		snapshotStmt := `WITH removable AS (` + removable + `) UPDATE event SET type = (?)
+			WHERE id IN (SELECT MAX(id) FROM removable GROUP BY key) AND type NOT IN ((?), (?), (?))`
+
+		snapshotArgs := append(append([]any{}, args...), model.SnapshotEvent, model.SnapshotEvent, model.DeleteEvent, model.EraseEvent)
+		res, err := tx.ExecContext(ctx, s.rebind(snapshotStmt), snapshotArgs...)
+		if err != nil {
+			return err
+		}
+
+		if report.Snapshots, err = res.RowsAffected(); err != nil {
+			return err
+		}
+
+		deleteStmt += ` AND id NOT IN (SELECT MAX(id) FROM removable GROUP BY key)`
+	}
+
+	res, err := tx.ExecContext(ctx, s.rebind(deleteStmt), deleteArgs...)
+	if err != nil {
+		return err
+	}
+
+	removed, err := res.RowsAffected()
+	report.RemovedEvents += removed
+	return err
+}
+
+func (s *storeImpl) EraseContext(ctx context.Context, key string, opts ...WriteOption) (*model.Event, error) {
+	e, err := s.erase(ctx, key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.dialect.purge != nil {
+		s.purgeErased(ctx)
+	}
+	return e, nil
+}
+
+func (s *storeImpl) erase(ctx context.Context, key string, opts []WriteOption) (*model.Event, error) {
+	o := applyWriteOptions(opts)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snap, err := s.getSnapshot(ctx, key, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM event WHERE key = (?) AND type <> (?)`), key, model.EraseEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	erased, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := erasureEvent(key, snap, o, erased)
+	if err != nil {
+		return nil, err
+	}
+
+	// the erasure event replaces the current value of the answer in the answer table as well
+	if err := s.insertEvent(ctx, e, tx); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.broker.publish(e)
+	return e, nil
+}
+
+const (
+	purgeRetryDelay    = 100 * time.Millisecond
+	maxPurgeRetryDelay = 10 * time.Second
+)
+
+// purgeErased purges the erased rows. Since the erasure is already committed, a failure is not returned
+// to the caller: the purge is retried in the background instead.
+func (s *storeImpl) purgeErased(ctx context.Context) {
+	if err := s.dialect.purge(ctx, s); err == nil {
+		return
+	}
+
+	s.purgeMu.Lock()
+	defer s.purgeMu.Unlock()
+
+	s.purgePending = true
+	if s.purging || s.closed {
+		return
+	}
+
+	if s.stopPurge == nil {
+		s.stopPurge = make(chan struct{})
+	}
+	s.purging = true
+	s.purgeWG.Add(1)
+	go s.retryPurge()
+}
+
+// retryPurge retries the purge, with an increasing delay, until it succeeds or the store is closed.
+func (s *storeImpl) retryPurge() {
+	defer s.purgeWG.Done()
+
+	delay := purgeRetryDelay
+	for {
+		select {
+		case <-s.stopPurge:
+			return
+		case <-time.After(delay):
+		}
+
+		s.purgeMu.Lock()
+		s.purgePending = false
+		s.purgeMu.Unlock()
+
+		err := s.dialect.purge(context.Background(), s)
+
+		s.purgeMu.Lock()
+		if err != nil {
+			s.purgePending = true
+		}
+
+		// a purge which failed concurrently with a successful retry may have missed later erasures
+		if !s.purgePending {
+			s.purging = false
+			s.purgeMu.Unlock()
+			return
+		}
+		s.purgeMu.Unlock()
+
+		if delay *= 2; delay > maxPurgeRetryDelay {
+			delay = maxPurgeRetryDelay
+		}
+	}
+}
+
+func (s *storeImpl) size(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.db.QueryRowContext(ctx, s.dialect.sizeQuery).Scan(&size)
+	return size, err
 }
 
 type rowIterator struct {
@@ -218,6 +958,10 @@ func (it *rowIterator) Value() (*model.Event, error) {
 	return scanEvent(it.rows)
 }
 
+func (it *rowIterator) Err() error {
+	return it.rows.Err()
+}
+
 func (it *rowIterator) Close() error {
 	return it.rows.Close()
 }
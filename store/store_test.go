@@ -1,28 +1,121 @@
 package store_test
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
 	"math/rand"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ostafen/demo/model"
 	"github.com/ostafen/demo/store"
 
+	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
 
-func runTest(t *testing.T, testFunc func(store store.EventStore, t *testing.T)) {
-	dir, err := os.MkdirTemp("", "test")
+// postgresURLEnv holds the URL of the PostgreSQL database used to test the postgres backend.
+// If it is not set, the postgres backend is not tested.
+const postgresURLEnv = "STORE_TEST_POSTGRES_URL"
+
+// backends lists the storage backends the test suite runs against. Each of them returns
+// the URL of an empty storage, together with a function releasing its resources.
+var backends = []struct {
+	name  string
+	setup func(t *testing.T) (string, func())
+}{
+	{"sqlite", setupDir("sqlite", "")},
+	{"sqlite-group-commit", setupDir("sqlite", "group_commit=true")},
+	{"file", setupDir("file", "")},
+	{"mem", func(t *testing.T) (string, func()) {
+		return "mem://", func() {}
+	}},
+	{"postgres", setupPostgres},
+}
+
+func backendAvailable(scheme string) bool {
+	for _, s := range store.Schemes() {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// setupDir creates the storage in a temporary directory. Query holds the parameters of the storage URL.
+func setupDir(scheme, query string) func(t *testing.T) (string, func()) {
+	return func(t *testing.T) (string, func()) {
+		if !backendAvailable(scheme) {
+			t.Skipf("the %s backend is not available in this build", scheme)
+		}
+
+		dir, err := os.MkdirTemp("", "test")
+		require.NoError(t, err)
+
+		rawURL := scheme + "://" + dir
+		if query != "" {
+			rawURL += "?" + query
+		}
+
+		return rawURL, func() {
+			require.NoError(t, os.RemoveAll(dir))
+		}
+	}
+}
+
+// setupPostgres isolates each test in its own schema.
+func setupPostgres(t *testing.T) (string, func()) {
+	rawURL := os.Getenv(postgresURLEnv)
+	if rawURL == "" {
+		t.Skipf("%s is not set", postgresURLEnv)
+	}
+
+	db, err := sql.Open("postgres", rawURL)
+	require.NoError(t, err)
+
+	schema := fmt.Sprintf("test_%d", rand.Int63())
+	_, err = db.Exec("CREATE SCHEMA " + schema)
 	require.NoError(t, err)
 
-	store, err := store.Open(dir)
+	u, err := url.Parse(rawURL)
 	require.NoError(t, err)
 
-	testFunc(store, t)
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	return u.String(), func() {
+		_, err := db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+	}
+}
+
+// runTest runs testFunc against an empty storage of each backend.
+func runTest(t *testing.T, testFunc func(store store.EventStore, t *testing.T)) {
+	for _, backend := range backends {
+		backend := backend
+
+		t.Run(backend.name, func(t *testing.T) {
+			rawURL, cleanup := backend.setup(t)
+			defer cleanup()
+
+			store, err := store.OpenURL(rawURL)
+			require.NoError(t, err)
+
+			testFunc(store, t)
 
-	require.NoError(t, store.Close())
-	require.NoError(t, os.RemoveAll(dir))
+			require.NoError(t, store.Close())
+		})
+	}
 }
 
 func TestCreateAndGetAnswer(t *testing.T) {
@@ -100,6 +193,7 @@ func TestCreateUpdateAndDelete(t *testing.T) {
 		n := 1000
 
 		keyState := make(map[string]*string)
+		keyVersion := make(map[string]int64)
 
 		for i := 0; i < n; i++ {
 			key := strconv.Itoa(rand.Intn(10))
@@ -112,6 +206,7 @@ func TestCreateUpdateAndDelete(t *testing.T) {
 				if keyState[key] == nil {
 					require.NoError(t, err)
 					keyState[key] = &value
+					keyVersion[key]++
 				} else {
 					require.Equal(t, err, store.ErrAnswerExist)
 				}
@@ -121,6 +216,7 @@ func TestCreateUpdateAndDelete(t *testing.T) {
 				if keyState[key] != nil {
 					require.NoError(t, err)
 					keyState[key] = &value
+					keyVersion[key]++
 				} else {
 					require.Equal(t, err, store.ErrAnswerNotExist)
 				}
@@ -129,6 +225,7 @@ func TestCreateUpdateAndDelete(t *testing.T) {
 				if keyState[key] != nil {
 					require.NoError(t, err)
 					keyState[key] = nil
+					keyVersion[key]++
 				} else {
 					require.Equal(t, err, store.ErrAnswerNotExist)
 				}
@@ -137,7 +234,7 @@ func TestCreateUpdateAndDelete(t *testing.T) {
 			if keyState[key] != nil {
 				a, err := s.GetAnswer(key)
 				require.NoError(t, err)
-				require.Equal(t, a, &model.Answer{Key: key, Value: *keyState[key]})
+				require.Equal(t, a, &model.Answer{Key: key, Value: *keyState[key], Version: keyVersion[key]})
 			}
 		}
 	})
@@ -153,7 +250,7 @@ func TestGetHistory(t *testing.T) {
 
 		evts := make([]*model.Event, 0)
 
-		evts = append(evts, &model.Event{Event: model.CreateEvent, Data: &model.Answer{Key: key, Value: "value"}})
+		evts = append(evts, &model.Event{ID: 1, Event: model.CreateEvent, Version: 1, Data: &model.Answer{Key: key, Value: "value", Version: 1}})
 
 		for i := 0; i < n; i++ {
 			switch randomEventType() {
@@ -162,7 +259,7 @@ func TestGetHistory(t *testing.T) {
 				err := s.Create(answ)
 				if err != store.ErrAnswerExist {
 					require.NoError(t, err)
-					evts = append(evts, &model.Event{Event: model.CreateEvent, Data: answ})
+					evts = append(evts, &model.Event{ID: answ.Version, Event: model.CreateEvent, Version: answ.Version, Data: answ})
 				}
 
 			case model.UpdateEvent:
@@ -170,15 +267,16 @@ func TestGetHistory(t *testing.T) {
 				err := s.Update(answ)
 				if err != store.ErrAnswerNotExist {
 					require.NoError(t, err)
-					evts = append(evts, &model.Event{Event: model.UpdateEvent, Data: answ})
+					evts = append(evts, &model.Event{ID: answ.Version, Event: model.UpdateEvent, Version: answ.Version, Data: answ})
 				}
 
 			case model.DeleteEvent:
-				answ := &model.Answer{Key: key, Value: ""}
+				version := int64(len(evts) + 1)
+				answ := &model.Answer{Key: key, Value: "", Version: version}
 				err := s.Delete(key)
 				if err != store.ErrAnswerNotExist {
 					require.NoError(t, err)
-					evts = append(evts, &model.Event{Event: model.DeleteEvent, Data: answ})
+					evts = append(evts, &model.Event{ID: version, Event: model.DeleteEvent, Version: version, Data: answ})
 				}
 			}
 		}
@@ -187,9 +285,15 @@ func TestGetHistory(t *testing.T) {
 		require.NoError(t, err)
 
 		i := 0
+		var lastTimestamp time.Time
 		for it.Next() {
 			e, err := it.Value()
 			require.NoError(t, err)
+
+			require.False(t, e.Timestamp.Before(lastTimestamp))
+			lastTimestamp = e.Timestamp
+			e.Timestamp = time.Time{}
+
 			require.Equal(t, e, evts[i])
 			i++
 		}
@@ -197,3 +301,1278 @@ func TestGetHistory(t *testing.T) {
 		require.NoError(t, it.Close())
 	})
 }
+
+func TestExpectedVersion(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		answ := &model.Answer{Key: "key", Value: "value"}
+
+		err := s.Create(answ)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), answ.Version)
+
+		err = s.Update(&model.Answer{Key: "key", Value: "value1"}, store.WithExpectedVersion(2))
+		require.Equal(t, err, store.ErrVersionMismatch)
+
+		updateAnsw := &model.Answer{Key: "key", Value: "value1"}
+		err = s.Update(updateAnsw, store.WithExpectedVersion(1))
+		require.NoError(t, err)
+		require.Equal(t, int64(2), updateAnsw.Version)
+
+		// a concurrent writer which read version 1 must not overwrite the update
+		err = s.Update(&model.Answer{Key: "key", Value: "value2"}, store.WithExpectedVersion(1))
+		require.Equal(t, err, store.ErrVersionMismatch)
+
+		err = s.Delete("key", store.WithExpectedVersion(1))
+		require.Equal(t, err, store.ErrVersionMismatch)
+
+		err = s.Delete("key", store.WithExpectedVersion(2))
+		require.NoError(t, err)
+
+		// versions keep increasing when an answer is created again after being deleted
+		recreated := &model.Answer{Key: "key", Value: "value"}
+		err = s.Create(recreated)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), recreated.Version)
+
+		answ, err = s.GetAnswer("key")
+		require.NoError(t, err)
+		require.Equal(t, recreated, answ)
+	})
+}
+
+func TestGetAnswerAt(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		n := 10
+
+		err := s.Create(&model.Answer{Key: "key", Value: "-1"})
+		require.NoError(t, err)
+
+		times := make([]time.Time, 0, n)
+		for i := 0; i < n; i++ {
+			time.Sleep(time.Millisecond)
+			times = append(times, time.Now())
+
+			err := s.Update(&model.Answer{Key: "key", Value: strconv.Itoa(i)})
+			require.NoError(t, err)
+
+			err = s.Create(&model.Answer{Key: "other" + strconv.Itoa(i), Value: strconv.Itoa(i)})
+			require.NoError(t, err)
+		}
+
+		err = s.Delete("key")
+		require.NoError(t, err)
+
+		_, err = s.GetAnswerAt("key", store.AsOf{})
+		require.Equal(t, err, store.ErrAnswerNotExist)
+
+		it, err := s.GetHistory("key")
+		require.NoError(t, err)
+
+		count := 0
+		for it.Next() {
+			e, err := it.Value()
+			require.NoError(t, err)
+
+			a, err := s.GetAnswerAt("key", store.AtTime(e.Timestamp))
+			if e.Event == model.DeleteEvent {
+				require.Equal(t, err, store.ErrAnswerNotExist)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, e.Data, a)
+			}
+			count++
+		}
+		require.NoError(t, it.Close())
+		require.Equal(t, n+2, count)
+
+		// the i-th update was recorded after times[i], so the answer at that time still holds the previous value
+		for i, ts := range times {
+			a, err := s.GetAnswerAt("key", store.AtTime(ts))
+			require.NoError(t, err)
+			require.Equal(t, strconv.Itoa(i-1), a.Value)
+		}
+
+		_, err = s.GetAnswerAt("key", store.AtTime(times[0].Add(-time.Hour)))
+		require.Equal(t, err, store.ErrAnswerNotExist)
+
+		// events are numbered globally: the first update of "key" is the second event of the store,
+		// while the first answer with key "other0" is the third one.
+		a, err := s.GetAnswerAt("key", store.AtSequence(2))
+		require.NoError(t, err)
+		require.Equal(t, "0", a.Value)
+
+		a, err = s.GetAnswerAt("key", store.AtSequence(3))
+		require.NoError(t, err)
+		require.Equal(t, "0", a.Value)
+
+		a, err = s.GetAnswerAt("other0", store.AtSequence(3))
+		require.NoError(t, err)
+		require.Equal(t, "0", a.Value)
+
+		_, err = s.GetAnswerAt("other0", store.AtSequence(2))
+		require.Equal(t, err, store.ErrAnswerNotExist)
+	})
+}
+
+func TestEventMetadata(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		metadata := map[string]string{"request_id": "1234", "client_ip": "127.0.0.1"}
+
+		err := s.Create(&model.Answer{Key: "key", Value: "value"}, store.WithActor("alice"), store.WithMetadata(metadata))
+		require.NoError(t, err)
+
+		err = s.Update(&model.Answer{Key: "key", Value: "value1"})
+		require.NoError(t, err)
+
+		err = s.Delete("key", store.WithActor("bob"))
+		require.NoError(t, err)
+
+		it, err := s.GetHistory("key")
+		require.NoError(t, err)
+
+		events := make([]*model.Event, 0)
+		for it.Next() {
+			e, err := it.Value()
+			require.NoError(t, err)
+			events = append(events, e)
+		}
+		require.NoError(t, it.Close())
+		require.Len(t, events, 3)
+
+		require.Equal(t, int64(1), events[0].ID)
+		require.Equal(t, "alice", events[0].Actor)
+		require.Equal(t, metadata, events[0].Metadata)
+
+		require.Equal(t, int64(2), events[1].ID)
+		require.Equal(t, "", events[1].Actor)
+		require.Nil(t, events[1].Metadata)
+
+		require.Equal(t, int64(3), events[2].ID)
+		require.Equal(t, "bob", events[2].Actor)
+	})
+}
+
+func readEvents(it store.EventIterator, err error) ([]*model.Event, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*model.Event, 0)
+	for it.Next() {
+		e, err := it.Value()
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	if err := it.Err(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return events, it.Close()
+}
+
+func TestQueryHistory(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		n := 100
+
+		err := s.Create(&model.Answer{Key: "key", Value: "-1"})
+		require.NoError(t, err)
+
+		var middle time.Time
+		for i := 0; i < n; i++ {
+			if i == n/2 {
+				time.Sleep(time.Millisecond)
+				middle = time.Now()
+			}
+
+			err := s.Update(&model.Answer{Key: "key", Value: strconv.Itoa(i)})
+			require.NoError(t, err)
+
+			err = s.Create(&model.Answer{Key: "other" + strconv.Itoa(i), Value: strconv.Itoa(i)})
+			require.NoError(t, err)
+		}
+
+		all, err := readEvents(s.GetHistory("key"))
+		require.NoError(t, err)
+		require.Len(t, all, n+1)
+
+		// iterate over pages in both directions
+		for _, descending := range []bool{false, true} {
+			pages := make([]*model.Event, 0)
+			opts := store.HistoryOptions{Limit: 7, Descending: descending}
+			for {
+				page, err := readEvents(s.QueryHistory("key", opts))
+				require.NoError(t, err)
+				require.LessOrEqual(t, len(page), 7)
+				if len(page) == 0 {
+					break
+				}
+				pages = append(pages, page...)
+				opts.After = page[len(page)-1].ID
+			}
+
+			require.Len(t, pages, len(all))
+			for i, e := range pages {
+				if descending {
+					require.Equal(t, all[len(all)-1-i], e)
+				} else {
+					require.Equal(t, all[i], e)
+				}
+			}
+		}
+
+		creates, err := readEvents(s.QueryHistory("key", store.HistoryOptions{Types: []model.EventType{model.CreateEvent}}))
+		require.NoError(t, err)
+		require.Equal(t, all[:1], creates)
+
+		recent, err := readEvents(s.QueryHistory("key", store.HistoryOptions{From: middle}))
+		require.NoError(t, err)
+		require.Equal(t, all[len(all)-n/2:], recent)
+
+		old, err := readEvents(s.QueryHistory("key", store.HistoryOptions{To: middle, Types: []model.EventType{model.UpdateEvent}}))
+		require.NoError(t, err)
+		require.Equal(t, all[1:len(all)-n/2], old)
+	})
+}
+
+func TestReadAll(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		n := 100
+
+		for i := 0; i < n; i++ {
+			err := s.Create(&model.Answer{Key: strconv.Itoa(i % 10), Value: strconv.Itoa(i)})
+			if err == store.ErrAnswerExist {
+				err = s.Update(&model.Answer{Key: strconv.Itoa(i % 10), Value: strconv.Itoa(i)})
+			}
+			require.NoError(t, err)
+		}
+
+		all, err := readEvents(s.ReadAll(0, 0))
+		require.NoError(t, err)
+		require.Len(t, all, n)
+
+		for i, e := range all {
+			require.Equal(t, int64(i+1), e.ID)
+			require.Equal(t, strconv.Itoa(i), e.Data.Value)
+		}
+
+		// a consumer catching up from the last sequence number it has seen
+		events := make([]*model.Event, 0)
+		from := int64(1)
+		for {
+			page, err := readEvents(s.ReadAll(from, 15))
+			require.NoError(t, err)
+			if len(page) == 0 {
+				break
+			}
+			events = append(events, page...)
+			from = page[len(page)-1].ID + 1
+		}
+		require.Equal(t, all, events)
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		n := 100
+
+		sub := s.Subscribe()
+
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+
+			for i := 0; i < n; i++ {
+				if err := s.Create(&model.Answer{Key: strconv.Itoa(i), Value: strconv.Itoa(i)}); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+
+		for i := 0; i < n; i++ {
+			e := <-sub.Events()
+			require.Equal(t, int64(i+1), e.ID)
+			require.Equal(t, model.CreateEvent, e.Event)
+			require.Equal(t, &model.Answer{Key: strconv.Itoa(i), Value: strconv.Itoa(i), Version: 1}, e.Data)
+		}
+
+		require.NoError(t, <-errCh)
+
+		sub.Close()
+		_, ok := <-sub.Events()
+		require.False(t, ok)
+
+		// failed writes are not notified
+		sub = s.Subscribe()
+		defer sub.Close()
+
+		err := s.Create(&model.Answer{Key: "0", Value: "0"})
+		require.Equal(t, store.ErrAnswerExist, err)
+
+		err = s.Delete("0")
+		require.NoError(t, err)
+
+		e := <-sub.Events()
+		require.Equal(t, model.DeleteEvent, e.Event)
+		require.Equal(t, int64(n+1), e.ID)
+	})
+}
+
+func listAll(s store.EventStore, opts store.ListOptions) ([]*model.Answer, error) {
+	answers := make([]*model.Answer, 0)
+	for {
+		page, cursor, err := s.ListAnswers(opts)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, page...)
+
+		if cursor == "" {
+			return answers, nil
+		}
+		opts.Cursor = cursor
+	}
+}
+
+func TestListAnswers(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		for _, team := range []string{"team-a", "team-b", "team-c"} {
+			for i := 0; i < 10; i++ {
+				err := s.Create(&model.Answer{Key: fmt.Sprintf("%s/%d", team, i), Value: fmt.Sprintf("Value %d of %s", i, team)})
+				require.NoError(t, err)
+			}
+		}
+
+		err := s.Delete("team-b/3")
+		require.NoError(t, err)
+
+		err = s.Update(&model.Answer{Key: "team-a/5", Value: "updated 100%"})
+		require.NoError(t, err)
+
+		all, err := listAll(s, store.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, all, 29)
+		for i := 1; i < len(all); i++ {
+			require.Less(t, all[i-1].Key, all[i].Key)
+		}
+
+		paged, err := listAll(s, store.ListOptions{Limit: 4})
+		require.NoError(t, err)
+		require.Equal(t, all, paged)
+
+		teamB, err := listAll(s, store.ListOptions{Prefix: "team-b/", Limit: 3, Descending: true})
+		require.NoError(t, err)
+		require.Len(t, teamB, 9)
+		require.Equal(t, "team-b/9", teamB[0].Key)
+		require.Equal(t, "team-b/0", teamB[8].Key)
+
+		matches, err := listAll(s, store.ListOptions{Query: "VALUE 7"})
+		require.NoError(t, err)
+		require.Len(t, matches, 3)
+
+		// special characters of the LIKE operator are matched literally
+		matches, err = listAll(s, store.ListOptions{Query: "100%"})
+		require.NoError(t, err)
+		require.Equal(t, []*model.Answer{{Key: "team-a/5", Value: "updated 100%", Version: 2}}, matches)
+
+		matches, err = listAll(s, store.ListOptions{Query: "_"})
+		require.NoError(t, err)
+		require.Len(t, matches, 0)
+
+		recent, err := listAll(s, store.ListOptions{SortBy: store.SortByUpdate, Descending: true, Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, recent, 29)
+		require.Equal(t, "team-a/5", recent[0].Key)
+		require.Equal(t, "team-c/9", recent[1].Key)
+
+		_, _, err = s.ListAnswers(store.ListOptions{Cursor: "invalid"})
+		require.Equal(t, store.ErrInvalidCursor, err)
+	})
+}
+
+func TestApply(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		err := s.Create(&model.Answer{Key: "existing", Value: "value"})
+		require.NoError(t, err)
+
+		ops := []store.Operation{
+			{Type: model.CreateEvent, Answer: &model.Answer{Key: "a", Value: "1"}},
+			{Type: model.UpdateEvent, Answer: &model.Answer{Key: "a", Value: "2"}, ExpectedVersion: 1},
+			{Type: model.UpdateEvent, Answer: &model.Answer{Key: "existing", Value: "updated"}},
+			{Type: model.DeleteEvent, Answer: &model.Answer{Key: "existing"}, ExpectedVersion: 2},
+		}
+
+		results, err := s.Apply(ops)
+		require.NoError(t, err)
+		require.Equal(t, []store.OperationResult{{Version: 1}, {Version: 2}, {Version: 2}, {Version: 3}}, results)
+		require.Equal(t, int64(2), ops[1].Answer.Version)
+
+		answ, err := s.GetAnswer("a")
+		require.NoError(t, err)
+		require.Equal(t, &model.Answer{Key: "a", Value: "2", Version: 2}, answ)
+
+		_, err = s.GetAnswer("existing")
+		require.Equal(t, store.ErrAnswerNotExist, err)
+
+		all, err := readEvents(s.ReadAll(0, 0))
+		require.NoError(t, err)
+		require.Len(t, all, 5)
+
+		// a failing operation aborts the whole batch
+		ops = []store.Operation{
+			{Type: model.CreateEvent, Answer: &model.Answer{Key: "b", Value: "1"}},
+			{Type: model.UpdateEvent, Answer: &model.Answer{Key: "a", Value: "3"}, ExpectedVersion: 1},
+			{Type: model.DeleteEvent, Answer: &model.Answer{Key: "a"}},
+		}
+
+		results, err = s.Apply(ops)
+		require.Equal(t, store.ErrBatchAborted, err)
+		require.Equal(t, []store.OperationResult{
+			{Err: store.ErrBatchAborted},
+			{Err: store.ErrVersionMismatch},
+			{Err: store.ErrBatchAborted},
+		}, results)
+
+		_, err = s.GetAnswer("b")
+		require.Equal(t, store.ErrAnswerNotExist, err)
+
+		answ, err = s.GetAnswer("a")
+		require.NoError(t, err)
+		require.Equal(t, int64(2), answ.Version)
+
+		all, err = readEvents(s.ReadAll(0, 0))
+		require.NoError(t, err)
+		require.Len(t, all, 5)
+
+		results, err = s.Apply([]store.Operation{{Type: model.EventType("unknown"), Answer: &model.Answer{Key: "a"}}})
+		require.Equal(t, store.ErrBatchAborted, err)
+		require.Equal(t, store.ErrInvalidOperation, results[0].Err)
+	})
+}
+
+func TestRestore(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		_, err := s.Restore("key", 1)
+		require.Equal(t, store.ErrAnswerNotExist, err)
+
+		for i := 0; i < 3; i++ {
+			if i == 0 {
+				err = s.Create(&model.Answer{Key: "key", Value: strconv.Itoa(i)})
+			} else {
+				err = s.Update(&model.Answer{Key: "key", Value: strconv.Itoa(i)})
+			}
+			require.NoError(t, err)
+		}
+
+		answ, err := s.Restore("key", 2, store.WithActor("alice"))
+		require.NoError(t, err)
+		require.Equal(t, &model.Answer{Key: "key", Value: "1", Version: 4}, answ)
+
+		err = s.Delete("key")
+		require.NoError(t, err)
+
+		// an answer can be brought back after a delete, without losing the link with its history
+		answ, err = s.Restore("key", 1, store.WithExpectedVersion(5))
+		require.NoError(t, err)
+		require.Equal(t, &model.Answer{Key: "key", Value: "0", Version: 6}, answ)
+
+		getAnsw, err := s.GetAnswer("key")
+		require.NoError(t, err)
+		require.Equal(t, answ, getAnsw)
+
+		_, err = s.Restore("key", 5)
+		require.Equal(t, store.ErrVersionNotRestorable, err)
+
+		_, err = s.Restore("key", 7)
+		require.Equal(t, store.ErrVersionNotExist, err)
+
+		_, err = s.Restore("key", 1, store.WithExpectedVersion(5))
+		require.Equal(t, store.ErrVersionMismatch, err)
+
+		events, err := readEvents(s.GetHistory("key"))
+		require.NoError(t, err)
+		require.Len(t, events, 6)
+		require.Equal(t, model.RestoreEvent, events[3].Event)
+		require.Equal(t, "alice", events[3].Actor)
+		require.Equal(t, model.RestoreEvent, events[5].Event)
+		require.Equal(t, answ, events[5].Data)
+
+		// a restored answer can be updated as usual
+		err = s.Update(&model.Answer{Key: "key", Value: "updated"}, store.WithExpectedVersion(6))
+		require.NoError(t, err)
+	})
+}
+
+func TestReopenLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := store.OpenLog(dir)
+	require.NoError(t, err)
+
+	err = s.Create(&model.Answer{Key: "key", Value: "0"}, store.WithMetadata(map[string]string{"request_id": "1"}))
+	require.NoError(t, err)
+
+	_, err = s.Apply([]store.Operation{
+		{Type: model.UpdateEvent, Answer: &model.Answer{Key: "key", Value: "1"}},
+		{Type: model.CreateEvent, Answer: &model.Answer{Key: "other", Value: "0"}},
+	})
+	require.NoError(t, err)
+
+	events, err := readEvents(s.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// simulate a crash in the middle of a write
+	f, err := os.OpenFile(filepath.Join(dir, "events.log"), os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteString(`[{"id":4,"event":"upd`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = store.OpenLog(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	reloaded, err := readEvents(s.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.Equal(t, events, reloaded)
+
+	answ, err := s.GetAnswer("key")
+	require.NoError(t, err)
+	require.Equal(t, &model.Answer{Key: "key", Value: "1", Version: 2}, answ)
+
+	// writes continue after the last complete batch
+	err = s.Update(&model.Answer{Key: "other", Value: "1"})
+	require.NoError(t, err)
+
+	events, err = readEvents(s.ReadAll(4, 0))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, int64(4), events[0].ID)
+}
+
+func TestCopy(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		src := store.OpenMemory()
+		defer src.Close()
+
+		for i := 0; i < 10; i++ {
+			key := strconv.Itoa(i % 3)
+
+			err := src.Create(&model.Answer{Key: key, Value: strconv.Itoa(i)}, store.WithActor("alice"))
+			if err == store.ErrAnswerExist {
+				err = src.Update(&model.Answer{Key: key, Value: strconv.Itoa(i)}, store.WithMetadata(map[string]string{"i": strconv.Itoa(i)}))
+			}
+			require.NoError(t, err)
+		}
+		require.NoError(t, src.Delete("0"))
+
+		n, err := store.Copy(s, src)
+		require.NoError(t, err)
+		require.Equal(t, int64(11), n)
+
+		events, err := readEvents(src.ReadAll(1, 0))
+		require.NoError(t, err)
+
+		copied, err := readEvents(s.ReadAll(1, 0))
+		require.NoError(t, err)
+		require.Equal(t, events, copied)
+
+		answers, err := listAll(s, store.ListOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []*model.Answer{{Key: "1", Value: "7", Version: 3}, {Key: "2", Value: "8", Version: 3}}, answers)
+
+		// new events follow the copied ones
+		err = s.Create(&model.Answer{Key: "0", Value: "new"})
+		require.NoError(t, err)
+
+		events, err = readEvents(s.GetHistory("0"))
+		require.NoError(t, err)
+		require.Len(t, events, 6)
+		require.Equal(t, int64(12), events[5].ID)
+		require.Equal(t, int64(6), events[5].Version)
+
+		_, err = store.Copy(s, src)
+		require.Equal(t, store.ErrNotEmpty, err)
+	})
+}
+
+func TestContextCancellation(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		n := 100
+		for i := 0; i < n; i++ {
+			err := s.CreateContext(context.Background(), &model.Answer{Key: strconv.Itoa(i), Value: "0"})
+			require.NoError(t, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := s.CreateContext(ctx, &model.Answer{Key: "cancelled", Value: "0"})
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, err = s.GetAnswer("cancelled")
+		require.Equal(t, store.ErrAnswerNotExist, err)
+
+		_, err = s.GetAnswerContext(ctx, "0")
+		require.ErrorIs(t, err, context.Canceled)
+
+		_, _, err = s.ListAnswersContext(ctx, store.ListOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+
+		// iterators stop as soon as their context is cancelled
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		it, err := s.ReadAllContext(ctx, 1, 0)
+		require.NoError(t, err)
+		defer it.Close()
+
+		require.True(t, it.Next())
+		cancel()
+
+		read := 1
+		require.Eventually(t, func() bool {
+			if it.Next() {
+				read++
+				return false
+			}
+			return true
+		}, time.Second, time.Millisecond)
+
+		require.Less(t, read, n)
+		require.ErrorIs(t, it.Err(), context.Canceled)
+	})
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		require.NoError(t, s.Create(&model.Answer{Key: "counter", Value: "0"}))
+
+		n := 16
+		updates := 10
+		created := make(chan bool, n)
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				// only one of the writers creating the same answer succeeds
+				err := s.Create(&model.Answer{Key: "shared", Value: strconv.Itoa(i)})
+				created <- err == nil
+				if err != nil && err != store.ErrAnswerExist {
+					errs <- err
+					return
+				}
+
+				for j := 0; j < updates; j++ {
+					if err := s.Update(&model.Answer{Key: "counter", Value: strconv.Itoa(i)}); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- nil
+			}(i)
+		}
+
+		successes := 0
+		for i := 0; i < n; i++ {
+			require.NoError(t, <-errs)
+			if <-created {
+				successes++
+			}
+		}
+		require.Equal(t, 1, successes)
+
+		answ, err := s.GetAnswer("counter")
+		require.NoError(t, err)
+		require.Equal(t, int64(1+n*updates), answ.Version)
+
+		events, err := readEvents(s.GetHistory("counter"))
+		require.NoError(t, err)
+		require.Len(t, events, 1+n*updates)
+
+		for i, e := range events {
+			require.Equal(t, int64(i+1), e.Version)
+		}
+	})
+}
+
+// BenchmarkConcurrentCreate measures the throughput of concurrent writers on a sqlite storage,
+// with and without group commit.
+func BenchmarkConcurrentCreate(b *testing.B) {
+	if !backendAvailable("sqlite") {
+		b.Skip("the sqlite backend is not available in this build")
+	}
+
+	for _, query := range []string{"group_commit=false", "group_commit=true"} {
+		b.Run(query, func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			s, err := store.OpenURL("sqlite://" + dir + "?" + query)
+			require.NoError(b, err)
+			defer s.Close()
+
+			var n int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+					if err := s.Create(&model.Answer{Key: key, Value: key}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "ops/s")
+		})
+	}
+}
+
+func TestBackup(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		for i := 0; i < 10; i++ {
+			key := strconv.Itoa(i % 3)
+
+			err := s.Create(&model.Answer{Key: key, Value: strconv.Itoa(i)}, store.WithActor("alice"))
+			if err == store.ErrAnswerExist {
+				err = s.Update(&model.Answer{Key: key, Value: strconv.Itoa(i)}, store.WithMetadata(map[string]string{"i": strconv.Itoa(i)}))
+			}
+			require.NoError(t, err)
+		}
+		require.NoError(t, s.Delete("0"))
+
+		var backup bytes.Buffer
+		require.NoError(t, s.Backup(&backup))
+
+		// writes following the backup are not part of it
+		require.NoError(t, s.Create(&model.Answer{Key: "after", Value: "backup"}))
+
+		dir, err := os.MkdirTemp("", "test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		n, err := store.RestoreBackup("file://"+dir, &backup)
+		require.NoError(t, err)
+		require.Equal(t, int64(11), n)
+
+		restored, err := store.OpenURL("file://" + dir)
+		require.NoError(t, err)
+		defer restored.Close()
+
+		events, err := readEvents(s.ReadAll(1, 11))
+		require.NoError(t, err)
+
+		restoredEvents, err := readEvents(restored.ReadAll(1, 0))
+		require.NoError(t, err)
+		require.Equal(t, events, restoredEvents)
+	})
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	s := store.OpenMemory()
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Create(&model.Answer{Key: strconv.Itoa(i), Value: "value"}))
+	}
+
+	var backup bytes.Buffer
+	require.NoError(t, s.Backup(&backup))
+
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dst, err := store.OpenURL("file://" + dir)
+	require.NoError(t, err)
+	require.NoError(t, dst.Create(&model.Answer{Key: "existing", Value: "value"}))
+	require.NoError(t, dst.Close())
+
+	data := backup.Bytes()
+	for _, invalid := range [][]byte{
+		data[:len(data)-1],
+		[]byte("not a backup\n"),
+		bytes.Replace(data, []byte(`"id":2`), []byte(`"id":1`), 1),
+	} {
+		_, err := store.RestoreBackup("file://"+dir, bytes.NewReader(invalid))
+		require.Error(t, err)
+	}
+
+	// the storage is left untouched
+	dst, err = store.OpenURL("file://" + dir)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	// and cannot be replaced while open
+	_, err = store.RestoreBackup("file://"+dir, bytes.NewReader(data))
+	require.Equal(t, store.ErrStorageInUse, err)
+
+	answers, err := listAll(dst, store.ListOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []*model.Answer{{Key: "existing", Value: "value", Version: 1}}, answers)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "events.log", entries[0].Name())
+	require.Equal(t, "storage.lock", entries[1].Name())
+}
+
+func TestExportImport(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		src := store.OpenMemory()
+		defer src.Close()
+
+		for i := 0; i < 10; i++ {
+			key := strconv.Itoa(i % 3)
+
+			err := src.Create(&model.Answer{Key: key, Value: strconv.Itoa(i)}, store.WithActor("alice"))
+			if err == store.ErrAnswerExist {
+				err = src.Update(&model.Answer{Key: key, Value: strconv.Itoa(i)}, store.WithMetadata(map[string]string{"i": strconv.Itoa(i)}))
+			}
+			require.NoError(t, err)
+		}
+		require.NoError(t, src.Delete("0"))
+
+		_, err := src.Restore("0", 2)
+		require.NoError(t, err)
+
+		var exported bytes.Buffer
+		n, err := store.Export(context.Background(), src, &exported)
+		require.NoError(t, err)
+		require.Equal(t, int64(12), n)
+
+		lines := bytes.SplitAfter(exported.Bytes(), []byte("\n"))
+		require.Len(t, lines, 13) // the last line is empty
+
+		// an interrupted import is resumed by importing the same data again
+		result, err := store.Import(context.Background(), s, bytes.NewReader(bytes.Join(lines[:5], nil)))
+		require.NoError(t, err)
+		require.Equal(t, store.ImportResult{Imported: 5}, result)
+
+		result, err = store.Import(context.Background(), s, bytes.NewReader(exported.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, store.ImportResult{Imported: 7, Skipped: 5}, result)
+
+		result, err = store.Import(context.Background(), s, bytes.NewReader(exported.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, store.ImportResult{Skipped: 12}, result)
+
+		events, err := readEvents(src.ReadAll(1, 0))
+		require.NoError(t, err)
+
+		imported, err := readEvents(s.ReadAll(1, 0))
+		require.NoError(t, err)
+		require.Equal(t, events, imported)
+
+		answ, err := s.GetAnswer("0")
+		require.NoError(t, err)
+		require.Equal(t, &model.Answer{Key: "0", Value: "3", Version: 6}, answ)
+
+		// events differing from the recorded ones are rejected
+		modified := bytes.Replace(exported.Bytes(), []byte(`"value":"9"`), []byte(`"value":"modified"`), 1)
+		result, err = store.Import(context.Background(), s, bytes.NewReader(modified))
+		require.ErrorIs(t, err, store.ErrEventConflict)
+		require.Equal(t, store.ImportResult{Skipped: 9}, result)
+
+		_, err = store.Import(context.Background(), s, bytes.NewReader([]byte("{\"id\":20}\n")))
+		require.ErrorIs(t, err, store.ErrInvalidEvent)
+
+		_, err = store.Import(context.Background(), s, bytes.NewReader(append(lines[1], lines[0]...)))
+		require.ErrorIs(t, err, store.ErrInvalidEvent)
+	})
+}
+
+func eventVersions(t *testing.T, s store.EventStore, key string) []int64 {
+	events, err := readEvents(s.GetHistory(key))
+	require.NoError(t, err)
+
+	versions := make([]int64, len(events))
+	for i, e := range events {
+		versions[i] = e.Version
+	}
+	return versions
+}
+
+func TestCompact(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		require.NoError(t, s.Create(&model.Answer{Key: "b", Value: "0"}))
+		require.NoError(t, s.Update(&model.Answer{Key: "b", Value: "1"}))
+		require.NoError(t, s.Delete("b"))
+
+		require.NoError(t, s.Create(&model.Answer{Key: "a", Value: "0"}))
+		for i := 1; i < 5; i++ {
+			require.NoError(t, s.Update(&model.Answer{Key: "a", Value: strconv.Itoa(i)}))
+		}
+		require.NoError(t, s.Create(&model.Answer{Key: "c", Value: "0"}))
+
+		report, err := s.Compact(store.RetentionPolicy{})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), report.RemovedEvents)
+
+		report, err = s.Compact(store.RetentionPolicy{KeepLast: 2})
+		require.NoError(t, err)
+		require.Equal(t, int64(4), report.RemovedEvents)
+		require.Equal(t, []int64{4, 5}, eventVersions(t, s, "a"))
+		require.Equal(t, []int64{2, 3}, eventVersions(t, s, "b"))
+		require.Equal(t, []int64{1}, eventVersions(t, s, "c"))
+
+		answ, err := s.GetAnswer("a")
+		require.NoError(t, err)
+		require.Equal(t, &model.Answer{Key: "a", Value: "4", Version: 5}, answ)
+
+		// the removed events are replaced by a snapshot of the state they led to
+		report, err = s.Compact(store.RetentionPolicy{KeepLast: 1, Snapshot: true})
+		require.NoError(t, err)
+		require.Equal(t, store.CompactionReport{Snapshots: 2, ReclaimedBytes: report.ReclaimedBytes}, report)
+
+		events, err := readEvents(s.GetHistory("a"))
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		require.Equal(t, model.SnapshotEvent, events[0].Event)
+		require.Equal(t, &model.Answer{Key: "a", Value: "3", Version: 4}, events[0].Data)
+
+		answ, err = s.GetAnswerAt("a", store.AtSequence(events[0].ID))
+		require.NoError(t, err)
+		require.Equal(t, &model.Answer{Key: "a", Value: "3", Version: 4}, answ)
+
+		events, err = readEvents(s.GetHistory("b"))
+		require.NoError(t, err)
+		require.Equal(t, []model.EventType{model.SnapshotEvent, model.DeleteEvent}, []model.EventType{events[0].Event, events[1].Event})
+
+		// the history of deleted answers is purged after the grace period
+		report, err = s.Compact(store.RetentionPolicy{PurgeDeletedAfter: time.Hour})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), report.PurgedAnswers)
+
+		report, err = s.Compact(store.RetentionPolicy{PurgeDeletedAfter: time.Nanosecond})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), report.PurgedAnswers)
+		require.Equal(t, int64(2), report.RemovedEvents)
+		require.Empty(t, eventVersions(t, s, "b"))
+
+		require.NoError(t, s.Create(&model.Answer{Key: "b", Value: "new"}))
+		require.Equal(t, []int64{1}, eventVersions(t, s, "b"))
+
+		// the last event of the log is never removed, so that its sequence number is not reused
+		require.NoError(t, s.Delete("c"))
+
+		report, err = s.Compact(store.RetentionPolicy{PurgeDeletedAfter: time.Nanosecond})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), report.PurgedAnswers)
+
+		require.NoError(t, s.Create(&model.Answer{Key: "d", Value: "0"}))
+		start := time.Now()
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, s.Update(&model.Answer{Key: "d", Value: "1"}))
+		require.NoError(t, s.Update(&model.Answer{Key: "d", Value: "2"}))
+
+		// events older than the retention period are removed, unless retained by the count limit
+		keepFor := time.Since(start) - 10*time.Millisecond
+
+		report, err = s.Compact(store.RetentionPolicy{KeepFor: keepFor, KeepLast: 4})
+		require.NoError(t, err)
+		require.Equal(t, int64(0), report.RemovedEvents)
+
+		report, err = s.Compact(store.RetentionPolicy{KeepFor: keepFor})
+		require.NoError(t, err)
+		require.Equal(t, []int64{2, 3}, eventVersions(t, s, "d"))
+
+		// deletions are not turned into snapshots
+		require.NoError(t, s.Create(&model.Answer{Key: "c", Value: "1"}))
+
+		_, err = s.Compact(store.RetentionPolicy{KeepLast: 1, Snapshot: true})
+		require.NoError(t, err)
+
+		events, err = readEvents(s.GetHistory("c"))
+		require.NoError(t, err)
+		require.Equal(t, []model.EventType{model.DeleteEvent, model.CreateEvent}, []model.EventType{events[0].Event, events[1].Event})
+
+		all, err := readEvents(s.ReadAll(1, 0))
+		require.NoError(t, err)
+
+		ids := make([]int64, len(all))
+		for i, e := range all {
+			ids[i] = e.ID
+		}
+		require.IsIncreasing(t, ids)
+		require.Equal(t, int64(15), ids[len(ids)-1])
+
+		_, err = s.Compact(store.RetentionPolicy{KeepLast: -1})
+		require.Error(t, err)
+	})
+}
+
+func TestCompactLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := store.OpenLog(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Create(&model.Answer{Key: "key", Value: "0"}))
+	for i := 1; i < 20; i++ {
+		require.NoError(t, s.Update(&model.Answer{Key: "key", Value: strconv.Itoa(i)}))
+	}
+
+	report, err := s.Compact(store.RetentionPolicy{KeepLast: 1, Snapshot: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(18), report.RemovedEvents)
+	require.Greater(t, report.ReclaimedBytes, int64(0))
+
+	events, err := readEvents(s.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = store.OpenLog(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	reloaded, err := readEvents(s.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.Equal(t, events, reloaded)
+
+	require.NoError(t, s.Update(&model.Answer{Key: "key", Value: "20"}))
+	require.Equal(t, []int64{19, 20, 21}, eventVersions(t, s, "key"))
+}
+
+func TestErase(t *testing.T) {
+	runTest(t, func(s store.EventStore, t *testing.T) {
+		const secret = "s3cr3t-value"
+
+		require.NoError(t, s.Create(&model.Answer{Key: "key", Value: secret + "-1"}))
+		require.NoError(t, s.Create(&model.Answer{Key: "other", Value: "public"}))
+		require.NoError(t, s.Update(&model.Answer{Key: "key", Value: secret + "-2"}))
+		require.NoError(t, s.Delete("key"))
+
+		_, err := s.Erase("missing")
+		require.ErrorIs(t, err, store.ErrAnswerNotExist)
+
+		_, err = s.Erase("key", store.WithExpectedVersion(2))
+		require.ErrorIs(t, err, store.ErrVersionMismatch)
+
+		e, err := s.Erase("key", store.WithActor("dpo"), store.WithMetadata(map[string]string{"reason": "request"}))
+		require.NoError(t, err)
+		require.Equal(t, model.EraseEvent, e.Event)
+		require.Equal(t, int64(5), e.ID)
+		require.Equal(t, "dpo", e.Actor)
+		require.Equal(t, map[string]string{"reason": "request", store.ErasedEventsMetadata: "3"}, e.Metadata)
+		require.Equal(t, &model.Answer{Key: "key", Version: 4}, e.Data)
+
+		// the erasure event is the only trace left of the answer
+		events, err := readEvents(s.GetHistory("key"))
+		require.NoError(t, err)
+		require.Equal(t, []*model.Event{e}, events)
+
+		_, err = s.GetAnswer("key")
+		require.ErrorIs(t, err, store.ErrAnswerNotExist)
+
+		_, err = s.GetAnswerAt("key", store.AtSequence(3))
+		require.ErrorIs(t, err, store.ErrAnswerNotExist)
+
+		_, err = s.Restore("key", 2)
+		require.ErrorIs(t, err, store.ErrVersionNotExist)
+
+		_, err = s.Restore("key", 4)
+		require.ErrorIs(t, err, store.ErrVersionNotRestorable)
+
+		var exported, backup bytes.Buffer
+		_, err = store.Export(context.Background(), s, &exported)
+		require.NoError(t, err)
+		require.NotContains(t, exported.String(), secret)
+		require.Equal(t, 2, strings.Count(exported.String(), "\n"))
+
+		require.NoError(t, s.Backup(&backup))
+		require.NotContains(t, backup.String(), secret)
+
+		// the answer can be created again, and erasure events are never removed
+		require.NoError(t, s.Create(&model.Answer{Key: "key", Value: secret + "-3"}))
+		require.Equal(t, []int64{4, 5}, eventVersions(t, s, "key"))
+
+		_, err = s.Compact(store.RetentionPolicy{KeepLast: 1})
+		require.NoError(t, err)
+		require.Equal(t, []int64{4, 5}, eventVersions(t, s, "key"))
+
+		e, err = s.Erase("key")
+		require.NoError(t, err)
+		require.Equal(t, "1", e.Metadata[store.ErasedEventsMetadata])
+		require.Equal(t, []int64{4, 6}, eventVersions(t, s, "key"))
+
+		_, err = s.Compact(store.RetentionPolicy{PurgeDeletedAfter: time.Nanosecond})
+		require.NoError(t, err)
+		require.Equal(t, []int64{4, 6}, eventVersions(t, s, "key"))
+
+		answ, err := s.GetAnswer("other")
+		require.NoError(t, err)
+		require.Equal(t, "public", answ.Value)
+	})
+}
+
+func TestEraseLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := store.OpenLog(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Create(&model.Answer{Key: "key", Value: "s3cr3t-value"}))
+	require.NoError(t, s.Create(&model.Answer{Key: "other", Value: "public"}))
+
+	_, err = s.Erase("key")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "events.log"))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "s3cr3t")
+
+	events, err := readEvents(s.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = store.OpenLog(dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	reloaded, err := readEvents(s.ReadAll(1, 0))
+	require.NoError(t, err)
+	require.Equal(t, events, reloaded)
+
+	require.NoError(t, s.Create(&model.Answer{Key: "key", Value: "new"}))
+	require.Equal(t, []int64{2, 3}, eventVersions(t, s, "key"))
+}
+
+func TestTenants(t *testing.T) {
+	for _, backend := range backends {
+		backend := backend
+
+		t.Run(backend.name, func(t *testing.T) {
+			rawURL, cleanup := backend.setup(t)
+			defer cleanup()
+
+			s, err := store.OpenURL(rawURL)
+			require.NoError(t, err)
+			defer s.Close()
+
+			tenants, err := store.OpenTenants(rawURL)
+			require.NoError(t, err)
+
+			ctx := context.Background()
+
+			names, err := tenants.List(ctx)
+			require.NoError(t, err)
+			require.Empty(t, names)
+
+			acme, err := tenants.Create(ctx, "acme")
+			require.NoError(t, err)
+
+			globex, err := tenants.Create(ctx, "globex-corp")
+			require.NoError(t, err)
+
+			_, err = tenants.Create(ctx, "acme")
+			require.Equal(t, store.ErrTenantExist, err)
+
+			for _, name := range []string{"", "Acme", "acme_corp", "-acme", "../acme", strings.Repeat("a", 64)} {
+				_, err = tenants.Create(ctx, name)
+				require.Equal(t, store.ErrInvalidTenant, err, name)
+			}
+
+			names, err = tenants.List(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []string{"acme", "globex-corp"}, names)
+
+			sub := globex.Subscribe()
+			defer sub.Close()
+
+			// the same key is written to each storage
+			require.NoError(t, s.Create(&model.Answer{Key: "key", Value: "default"}))
+			require.NoError(t, acme.Create(&model.Answer{Key: "key", Value: "acme"}))
+			require.NoError(t, acme.Update(&model.Answer{Key: "key", Value: "acme-2"}))
+			require.NoError(t, globex.Create(&model.Answer{Key: "key", Value: "globex"}))
+
+			// and the events of a tenant are neither visible to the others nor delivered to their subscribers
+			for storage, values := range map[store.EventStore][]string{s: {"default"}, acme: {"acme", "acme-2"}, globex: {"globex"}} {
+				events, err := readEvents(storage.ReadAll(1, 0))
+				require.NoError(t, err)
+				require.Equal(t, values, eventValues(events))
+
+				history, err := readEvents(storage.GetHistory("key"))
+				require.NoError(t, err)
+				require.Equal(t, values, eventValues(history))
+			}
+
+			select {
+			case e := <-sub.Events():
+				require.Equal(t, "globex", e.Data.Value)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event received")
+			}
+
+			answers, _, err := globex.ListAnswers(store.ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, answers, 1)
+
+			if backend.name != "mem" {
+				// the storages of the tenants are persisted
+				require.NoError(t, tenants.Close())
+
+				tenants, err = store.OpenTenants(rawURL)
+				require.NoError(t, err)
+
+				acme, err = tenants.Get(ctx, "acme")
+				require.NoError(t, err)
+
+				answ, err := acme.GetAnswer("key")
+				require.NoError(t, err)
+				require.Equal(t, "acme-2", answ.Value)
+			}
+			defer tenants.Close()
+
+			_, err = tenants.Get(ctx, "initech")
+			require.Equal(t, store.ErrTenantNotExist, err)
+
+			// a deleted tenant loses its events, even when created again
+			require.NoError(t, tenants.Delete(ctx, "acme"))
+			require.Equal(t, store.ErrTenantNotExist, tenants.Delete(ctx, "acme"))
+
+			_, err = tenants.Get(ctx, "acme")
+			require.Equal(t, store.ErrTenantNotExist, err)
+
+			acme, err = tenants.Create(ctx, "acme")
+			require.NoError(t, err)
+
+			_, err = acme.GetAnswer("key")
+			require.Equal(t, store.ErrAnswerNotExist, err)
+
+			require.NoError(t, tenants.Delete(ctx, "acme"))
+			require.NoError(t, tenants.Delete(ctx, "globex-corp"))
+
+			names, err = tenants.List(ctx)
+			require.NoError(t, err)
+			require.Empty(t, names)
+
+			answ, err := s.GetAnswer("key")
+			require.NoError(t, err)
+			require.Equal(t, "default", answ.Value)
+		})
+	}
+}
+
+func eventValues(events []*model.Event) []string {
+	values := make([]string, len(events))
+	for i, e := range events {
+		values[i] = e.Data.Value
+	}
+	return values
+}
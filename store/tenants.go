@@ -0,0 +1,372 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrTenantExist    = errors.New("the tenant already exists")
+	ErrTenantNotExist = errors.New("the tenant does not exist")
+	ErrInvalidTenant  = errors.New("tenant names must be made of at most 63 lowercase letters, digits and inner hyphens")
+)
+
+var tenantName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantsDir is the directory holding the storages of the tenants, within the directory of a storage.
+const tenantsDir = "tenants"
+
+// namespace locates the storages of the tenants sharing the location of a storage.
+type namespace interface {
+	// url returns the URL of the storage of a tenant.
+	url(tenant string) string
+	exists(ctx context.Context, tenant string) (bool, error)
+	list(ctx context.Context) ([]string, error)
+	// create prepares the location of the storage of a new tenant, failing with ErrTenantExist if it is taken.
+	create(ctx context.Context, tenant string) error
+	// remove deletes the storage of a tenant, which must have been closed.
+	remove(ctx context.Context, tenant string) error
+	close() error
+}
+
+// Tenants manages the storages of the tenants sharing the location of a storage. Each tenant has its own storage,
+// isolated from the others and from the one at the shared location: a directory under the "tenants" directory
+// of the sqlite and file backends, a schema for PostgreSQL, or a separate in-memory storage.
+// Storages are opened on first use, and kept open until the tenant is deleted or Tenants is closed.
+type Tenants struct {
+	ns namespace
+
+	mu     sync.Mutex
+	stores map[string]EventStore
+}
+
+// OpenTenants manages the tenants of the storage identified by rawURL, in the format accepted by OpenURL.
+func OpenTenants(rawURL string) (*Tenants, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var ns namespace
+	switch u.Scheme {
+	case "mem":
+		ns = &memNamespace{tenants: make(map[string]struct{})}
+	case "postgres", "postgresql":
+		ns, err = openPostgresNamespace(u)
+	default:
+		ns = &dirNamespace{u: u, dir: path.Join(urlPath(u), tenantsDir)}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &Tenants{ns: ns, stores: make(map[string]EventStore)}, nil
+}
+
+// Create creates the storage of a new tenant, and returns it.
+func (t *Tenants) Create(ctx context.Context, tenant string) (EventStore, error) {
+	if !tenantName.MatchString(tenant) {
+		return nil, ErrInvalidTenant
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.ns.create(ctx, tenant); err != nil {
+		return nil, err
+	}
+
+	s, err := OpenURL(t.ns.url(tenant))
+	if err != nil {
+		t.ns.remove(ctx, tenant)
+		return nil, err
+	}
+
+	t.stores[tenant] = s
+	return s, nil
+}
+
+// Get returns the storage of a tenant, or ErrTenantNotExist.
+func (t *Tenants) Get(ctx context.Context, tenant string) (EventStore, error) {
+	if !tenantName.MatchString(tenant) {
+		return nil, ErrTenantNotExist
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.stores[tenant]; ok {
+		return s, nil
+	}
+
+	exists, err := t.ns.exists(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, ErrTenantNotExist
+	}
+
+	s, err := OpenURL(t.ns.url(tenant))
+	if err != nil {
+		return nil, err
+	}
+
+	t.stores[tenant] = s
+	return s, nil
+}
+
+// List returns the names of the tenants in ascending order.
+func (t *Tenants) List(ctx context.Context) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tenants, err := t.ns.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// Delete closes the storage of a tenant, and permanently removes it with all its events.
+func (t *Tenants) Delete(ctx context.Context, tenant string) error {
+	if !tenantName.MatchString(tenant) {
+		return ErrTenantNotExist
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.stores[tenant]; ok {
+		delete(t.stores, tenant)
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	return t.ns.remove(ctx, tenant)
+}
+
+// Close closes the storages of the tenants.
+func (t *Tenants) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var firstErr error
+	for tenant, s := range t.stores {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(t.stores, tenant)
+	}
+
+	if err := t.ns.close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// dirNamespace keeps the storage of each tenant in a subdirectory of the "tenants" directory.
+type dirNamespace struct {
+	u   *url.URL
+	dir string
+}
+
+func (ns *dirNamespace) url(tenant string) string {
+	// the options of the storage, such as the sqlite tuning parameters, apply to the storages of the tenants as well
+	u := dirURL(ns.u.Scheme, path.Join(ns.dir, tenant))
+	u.RawQuery = ns.u.RawQuery
+	return u.String()
+}
+
+func (ns *dirNamespace) exists(ctx context.Context, tenant string) (bool, error) {
+	info, err := os.Stat(path.Join(ns.dir, tenant))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil && info.IsDir(), err
+}
+
+func (ns *dirNamespace) list(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(ns.dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && tenantName.MatchString(entry.Name()) {
+			tenants = append(tenants, entry.Name())
+		}
+	}
+	return tenants, nil
+}
+
+func (ns *dirNamespace) create(ctx context.Context, tenant string) error {
+	if err := os.MkdirAll(ns.dir, 0755); err != nil {
+		return err
+	}
+
+	err := os.Mkdir(path.Join(ns.dir, tenant), 0755)
+	if os.IsExist(err) {
+		return ErrTenantExist
+	}
+	return err
+}
+
+func (ns *dirNamespace) remove(ctx context.Context, tenant string) error {
+	if exists, err := ns.exists(ctx, tenant); err != nil {
+		return err
+	} else if !exists {
+		return ErrTenantNotExist
+	}
+	return os.RemoveAll(path.Join(ns.dir, tenant))
+}
+
+func (ns *dirNamespace) close() error {
+	return nil
+}
+
+// memNamespace keeps track of the tenants of in-memory storages, which are lost when closed.
+type memNamespace struct {
+	tenants map[string]struct{}
+}
+
+func (ns *memNamespace) url(tenant string) string {
+	return "mem://"
+}
+
+func (ns *memNamespace) exists(ctx context.Context, tenant string) (bool, error) {
+	// the storages of existing tenants are never closed, so they are found before being looked up
+	_, ok := ns.tenants[tenant]
+	return ok, nil
+}
+
+func (ns *memNamespace) list(ctx context.Context) ([]string, error) {
+	tenants := make([]string, 0, len(ns.tenants))
+	for tenant := range ns.tenants {
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+func (ns *memNamespace) create(ctx context.Context, tenant string) error {
+	if _, ok := ns.tenants[tenant]; ok {
+		return ErrTenantExist
+	}
+	ns.tenants[tenant] = struct{}{}
+	return nil
+}
+
+func (ns *memNamespace) remove(ctx context.Context, tenant string) error {
+	if _, ok := ns.tenants[tenant]; !ok {
+		return ErrTenantNotExist
+	}
+	delete(ns.tenants, tenant)
+	return nil
+}
+
+func (ns *memNamespace) close() error {
+	return nil
+}
+
+// tenantSchemaPrefix prefixes the names of the PostgreSQL schemas of the tenants, whose hyphens are replaced by
+// underscores, which are not allowed in tenant names.
+const tenantSchemaPrefix = "tenant_"
+
+// postgresNamespace keeps the tables of each tenant in its own schema of the database.
+type postgresNamespace struct {
+	u  *url.URL
+	db *sql.DB
+}
+
+func openPostgresNamespace(u *url.URL) (*postgresNamespace, error) {
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, err
+	}
+	return &postgresNamespace{u: u, db: db}, nil
+}
+
+func tenantSchema(tenant string) string {
+	return tenantSchemaPrefix + strings.ReplaceAll(tenant, "-", "_")
+}
+
+func (ns *postgresNamespace) url(tenant string) string {
+	u := *ns.u
+	query := u.Query()
+	query.Set("search_path", tenantSchema(tenant))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (ns *postgresNamespace) exists(ctx context.Context, tenant string) (bool, error) {
+	var exists bool
+	err := ns.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM information_schema.schemata WHERE schema_name = $1)`, tenantSchema(tenant)).Scan(&exists)
+	return exists, err
+}
+
+func (ns *postgresNamespace) list(ctx context.Context) ([]string, error) {
+	rows, err := ns.db.QueryContext(ctx,
+		`SELECT schema_name FROM information_schema.schemata WHERE schema_name LIKE $1`, `tenant\_%`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := make([]string, 0)
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, err
+		}
+
+		tenant := strings.ReplaceAll(strings.TrimPrefix(schema, tenantSchemaPrefix), "_", "-")
+		if tenantName.MatchString(tenant) {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants, rows.Err()
+}
+
+// errors reported by PostgreSQL, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgDuplicateSchema   = "42P06"
+	pgInvalidSchemaName = "3F000"
+)
+
+func (ns *postgresNamespace) create(ctx context.Context, tenant string) error {
+	_, err := ns.db.ExecContext(ctx, `CREATE SCHEMA `+pq.QuoteIdentifier(tenantSchema(tenant)))
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == pgDuplicateSchema {
+		return ErrTenantExist
+	}
+	return err
+}
+
+func (ns *postgresNamespace) remove(ctx context.Context, tenant string) error {
+	_, err := ns.db.ExecContext(ctx, `DROP SCHEMA `+pq.QuoteIdentifier(tenantSchema(tenant))+` CASCADE`)
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == pgInvalidSchemaName {
+		return ErrTenantNotExist
+	}
+	return err
+}
+
+func (ns *postgresNamespace) close() error {
+	return ns.db.Close()
+}
@@ -0,0 +1,32 @@
+-- schema created by the last release which upgraded databases in place, without tracking the schema version
+CREATE TABLE event (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"type" TEXT NOT NULL,
+	"key" TEXT,
+	"value" TEXT NULL,
+	"version" integer NOT NULL DEFAULT 0,
+	"timestamp" integer NOT NULL DEFAULT 0,
+	"actor" TEXT NULL,
+	"metadata" TEXT NULL
+);
+CREATE INDEX key_index ON event(key);
+
+CREATE TABLE answer (
+	"key" TEXT NOT NULL PRIMARY KEY,
+	"value" TEXT NULL,
+	"version" integer NOT NULL,
+	"deleted" integer NOT NULL DEFAULT 0,
+	"event_id" integer NOT NULL,
+	"timestamp" integer NOT NULL DEFAULT 0
+);
+CREATE INDEX answer_event_index ON answer(event_id);
+
+INSERT INTO event(type, key, value, version, timestamp, actor, metadata) VALUES
+	('create', 'a', '1', 1, 1600000000000000000, 'alice', NULL),
+	('create', 'b', '1', 1, 1600000001000000000, NULL, '{"request_id":"1"}'),
+	('update', 'a', '2', 2, 1600000002000000000, 'bob', NULL),
+	('delete', 'b', '', 2, 1600000003000000000, NULL, NULL);
+
+INSERT INTO answer(key, value, version, deleted, event_id, timestamp) VALUES
+	('a', '2', 2, 0, 3, 1600000002000000000),
+	('b', '', 2, 1, 4, 1600000003000000000);
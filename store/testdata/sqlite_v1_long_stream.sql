@@ -0,0 +1,15 @@
+-- schema used before versions were introduced, holding a long stream of updates of a single answer
+CREATE TABLE event (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"type" TEXT NOT NULL,
+	"key" TEXT,
+	"value" TEXT NULL
+);
+CREATE INDEX key_index ON event(key);
+
+INSERT INTO event(type, key, value) VALUES ('create', 'a', '0'), ('create', 'b', '0');
+
+WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 100000)
+INSERT INTO event(type, key, value) SELECT 'update', 'a', i FROM n;
+
+INSERT INTO event(type, key, value) VALUES ('update', 'b', '1');
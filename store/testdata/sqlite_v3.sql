@@ -0,0 +1,16 @@
+-- schema used after timestamps were introduced, and before event metadata
+CREATE TABLE event (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"type" TEXT NOT NULL,
+	"key" TEXT,
+	"value" TEXT NULL,
+	"version" integer NOT NULL DEFAULT 0,
+	"timestamp" integer NOT NULL DEFAULT 0
+);
+CREATE INDEX key_index ON event(key);
+
+INSERT INTO event(type, key, value, version, timestamp) VALUES
+	('create', 'a', '1', 1, 1600000000000000000),
+	('create', 'b', '1', 1, 1600000001000000000),
+	('update', 'a', '2', 2, 1600000002000000000),
+	('delete', 'b', '', 2, 1600000003000000000);